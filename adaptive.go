@@ -0,0 +1,51 @@
+package main
+
+import (
+  "math"
+  "time"
+)
+
+// 根据商品最近的价格变动次数和关注人数计算下次分发的时间：
+// 平均每次价格变动的间隔内抓取两次，没人关注的商品间隔加倍，
+// 关注人数越多间隔越短，最终限制在min_interval和max_interval之间
+func nextDispatchTime(s Store, productID string, now time.Time) (time.Time, error) {
+  min, max := adaptiveIntervals()
+  history := Conf.Adaptive.History
+  if history <= 0 {
+    history = 30
+  }
+  h := time.Hour * 24 * time.Duration(history)
+  n, e := s.CountUpdates(productID, now.Add(-h))
+  if e != nil {
+    return now, e
+  }
+  w, e := s.CountWatchers(productID)
+  if e != nil {
+    return now, e
+  }
+  d := h / time.Duration(n+1) / 2
+  if w == 0 {
+    d *= 2
+  } else {
+    d = time.Duration(float64(d) / (1 + math.Log2(float64(w))))
+  }
+  if d < min {
+    d = min
+  }
+  if d > max {
+    d = max
+  }
+  return now.Add(d), nil
+}
+
+func adaptiveIntervals() (time.Duration, time.Duration) {
+  min := time.Minute * time.Duration(Conf.Adaptive.MinInterval)
+  if min <= 0 {
+    min = time.Minute * 30
+  }
+  max := time.Minute * time.Duration(Conf.Adaptive.MaxInterval)
+  if max < min {
+    max = min
+  }
+  return min, max
+}
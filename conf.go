@@ -7,10 +7,19 @@ import (
 )
 
 var Conf = &struct {
-  Log       LogConf       `yaml:"log"`
-  Beanstalk BeanstalkConf `yaml:"beanstalk"`
-  Database  DatabaseConf  `yaml:"database"`
-  Task      TaskConf      `yaml:"task"`
+  Log          LogConf          `yaml:"log"`
+  Queue        QueueConf        `yaml:"queue"`
+  Beanstalk    BeanstalkConf    `yaml:"beanstalk"`
+  Database     DatabaseConf     `yaml:"database"`
+  Task         TaskConf         `yaml:"task"`
+  Retry        RetryConf        `yaml:"retry"`
+  ProductRetry ProductRetryConf `yaml:"product_retry"`
+  Adaptive     AdaptiveConf     `yaml:"adaptive"`
+  Priority     PriorityConf     `yaml:"priority"`
+  Sources      []*SourceConf    `yaml:"sources"`
+  Notify       NotifyConf       `yaml:"notify"`
+  Metrics      MetricsConf      `yaml:"metrics"`
+  Health       HealthConf       `yaml:"health"`
 }{}
 
 type LogConf struct {
@@ -18,6 +27,10 @@ type LogConf struct {
   Level string `yaml:"level"`
 }
 
+type QueueConf struct {
+  Driver string `yaml:"driver"`
+}
+
 type BeanstalkConf struct {
   Host            string `yaml:"host"`
   Port            int    `yaml:"port"`
@@ -31,6 +44,7 @@ type BeanstalkConf struct {
 }
 
 type DatabaseConf struct {
+  Driver   string            `yaml:"driver"`
   Host     string            `yaml:"host"`
   Port     int               `yaml:"port"`
   DB       string            `yaml:"db"`
@@ -40,9 +54,85 @@ type DatabaseConf struct {
 }
 
 type TaskConf struct {
-  PollingInterval  int `yaml:"polling_interval"`
-  DispatchDuration int `yaml:"dispatch_duration"`
-  Overload         int `yaml:"overload"`
+  PollingInterval    int             `yaml:"polling_interval"`
+  MsgPollingInterval int             `yaml:"msg_polling_interval"`
+  DispatchDuration   int             `yaml:"dispatch_duration"`
+  Overload           int             `yaml:"overload"`
+  ShutdownTimeout    int             `yaml:"shutdown_timeout"`
+  Workers            int             `yaml:"workers"`
+  AuditRetention     int             `yaml:"audit_retention"`
+  Schedules          []*ScheduleRule `yaml:"schedules"`
+}
+
+type RetryConf struct {
+  MaxAttempts      int `yaml:"max_attempts"`
+  Delay            int `yaml:"delay"`
+  MaxDelay         int `yaml:"max_delay"`
+  FailureRetention int `yaml:"failure_retention"`
+}
+
+type ProductRetryConf struct {
+  Delay       int `yaml:"delay"`
+  MaxFailures int `yaml:"max_failures"`
+}
+
+type AdaptiveConf struct {
+  Enabled     bool `yaml:"enabled"`
+  MinInterval int  `yaml:"min_interval"`
+  MaxInterval int  `yaml:"max_interval"`
+  History     int  `yaml:"history"`
+}
+
+type PriorityConf struct {
+  Enabled    bool            `yaml:"enabled"`
+  Candidates int             `yaml:"candidates"`
+  Batch      int             `yaml:"batch"`
+  Scale      int             `yaml:"scale"`
+  FreshHours int             `yaml:"fresh_hours"`
+  Weights    PriorityWeights `yaml:"weights"`
+}
+
+type PriorityWeights struct {
+  Watchers  float64 `yaml:"watchers"`
+  Threshold float64 `yaml:"threshold"`
+  Staleness float64 `yaml:"staleness"`
+  Fresh     float64 `yaml:"fresh"`
+}
+
+type SourceConf struct {
+  Source   int     `yaml:"source"`
+  Tube     string  `yaml:"tube"`
+  Overload int     `yaml:"overload"`
+  Interval int     `yaml:"interval"`
+  Rate     float64 `yaml:"rate"`
+  Burst    int     `yaml:"burst"`
+}
+
+type NotifyConf struct {
+  TemplateDir   string       `yaml:"template_dir"`
+  DefaultLocale string       `yaml:"default_locale"`
+  PushVersion   int          `yaml:"push_version"`
+  Groupings     []string     `yaml:"groupings"`
+  Cooldown      CooldownConf `yaml:"cooldown"`
+  NewLowOnly    bool         `yaml:"new_low_only"`
+}
+
+type CooldownConf struct {
+  Decrease int `yaml:"decrease"`
+  Increase int `yaml:"increase"`
+  Range    int `yaml:"range"`
+}
+
+type MetricsConf struct {
+  Enabled bool   `yaml:"enabled"`
+  Listen  string `yaml:"listen"`
+  Path    string `yaml:"path"`
+}
+
+type HealthConf struct {
+  Enabled    bool   `yaml:"enabled"`
+  Listen     string `yaml:"listen"`
+  MaxTickAge int    `yaml:"max_tick_age"`
 }
 
 func LoadConf(file string) error {
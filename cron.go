@@ -0,0 +1,114 @@
+package main
+
+import (
+  "fmt"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// cron表达式：分 时 日 月 周，
+// 每个字段支持*、数字、范围（a-b）、步长（*/n、a-b/n）和列表（a,b,c），
+// 周的取值是0-7（0和7都是周日），
+// 日和周都不是*（以*开头，如*/2也算）时，满足其中一个即可（和标准cron一致）
+type cronExpr struct {
+  minute  []bool
+  hour    []bool
+  dom     []bool
+  month   []bool
+  dow     []bool
+  domStar bool
+  dowStar bool
+}
+
+func parseCron(expr string) (*cronExpr, error) {
+  fields := strings.Fields(expr)
+  if len(fields) != 5 {
+    return nil, fmt.Errorf("cron %q: expected 5 fields, got %d", expr, len(fields))
+  }
+  c := &cronExpr{
+    domStar: strings.HasPrefix(fields[2], "*"),
+    dowStar: strings.HasPrefix(fields[4], "*"),
+  }
+  var e error
+  if c.minute, e = parseCronField(fields[0], 0, 59); e != nil {
+    return nil, fmt.Errorf("cron %q: minute: %s", expr, e)
+  }
+  if c.hour, e = parseCronField(fields[1], 0, 23); e != nil {
+    return nil, fmt.Errorf("cron %q: hour: %s", expr, e)
+  }
+  if c.dom, e = parseCronField(fields[2], 1, 31); e != nil {
+    return nil, fmt.Errorf("cron %q: day of month: %s", expr, e)
+  }
+  if c.month, e = parseCronField(fields[3], 1, 12); e != nil {
+    return nil, fmt.Errorf("cron %q: month: %s", expr, e)
+  }
+  if c.dow, e = parseCronField(fields[4], 0, 7); e != nil {
+    return nil, fmt.Errorf("cron %q: day of week: %s", expr, e)
+  }
+  if c.dow[7] {
+    c.dow[0] = true
+  }
+  return c, nil
+}
+
+func parseCronField(field string, min, max int) ([]bool, error) {
+  ret := make([]bool, max+1)
+  for _, part := range strings.Split(field, ",") {
+    step := 1
+    if i := strings.Index(part, "/"); i >= 0 {
+      n, e := strconv.Atoi(part[i+1:])
+      if e != nil || n <= 0 {
+        return nil, fmt.Errorf("invalid step %q", part)
+      }
+      step = n
+      part = part[:i]
+    }
+    lo, hi := min, max
+    switch {
+    case part == "*":
+    case strings.Contains(part, "-"):
+      i := strings.Index(part, "-")
+      a, e1 := strconv.Atoi(part[:i])
+      b, e2 := strconv.Atoi(part[i+1:])
+      if e1 != nil || e2 != nil || a > b {
+        return nil, fmt.Errorf("invalid range %q", part)
+      }
+      lo, hi = a, b
+    default:
+      n, e := strconv.Atoi(part)
+      if e != nil {
+        return nil, fmt.Errorf("invalid value %q", part)
+      }
+      lo = n
+      hi = n
+      if step > 1 {
+        hi = max
+      }
+    }
+    if lo < min || hi > max {
+      return nil, fmt.Errorf("%q out of range [%d, %d]", part, min, max)
+    }
+    for v := lo; v <= hi; v += step {
+      ret[v] = true
+    }
+  }
+  return ret, nil
+}
+
+// 除了分钟以外的字段是否匹配，即t所在的这一小时是否在表达式范围内
+func (c *cronExpr) matchHour(t time.Time) bool {
+  if !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+    return false
+  }
+  d := c.dom[t.Day()]
+  w := c.dow[int(t.Weekday())]
+  if c.domStar || c.dowStar {
+    return d && w
+  }
+  return d || w
+}
+
+func (c *cronExpr) match(t time.Time) bool {
+  return c.minute[t.Minute()] && c.matchHour(t)
+}
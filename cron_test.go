@@ -0,0 +1,89 @@
+package main
+
+import (
+  "testing"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+)
+
+func shTime(s string) time.Time {
+  t, e := time.ParseInLocation(times.DateTimeFormat, s, times.TimeZoneSH)
+  if e != nil {
+    panic(e)
+  }
+  return t
+}
+
+func TestParseCronError(t *testing.T) {
+  for _, expr := range []string{
+    "* * * *",
+    "* * * * * *",
+    "60 * * * *",
+    "* 24 * * *",
+    "* * 0 * *",
+    "* * * 13 *",
+    "* * * * 8",
+    "*/0 * * * *",
+    "*/a * * * *",
+    "5-1 * * * *",
+    "a * * * *",
+    "1-a * * * *",
+    "1,,2 * * * *",
+  } {
+    if _, e := parseCron(expr); e == nil {
+      t.Errorf("%q: expected error", expr)
+    }
+  }
+}
+
+func TestCronMatch(t *testing.T) {
+  // 2026-10-19是周一，2026-11-01是周日
+  cases := []struct {
+    expr string
+    t    string
+    want bool
+  }{
+    {"* * * * *", "2026-10-19 10:31", true},
+    {"*/15 * * * *", "2026-10-19 10:30", true},
+    {"*/15 * * * *", "2026-10-19 10:31", false},
+    // a/n表示从a开始到最大值，每n个
+    {"5/15 * * * *", "2026-10-19 10:05", true},
+    {"5/15 * * * *", "2026-10-19 10:50", true},
+    {"5/15 * * * *", "2026-10-19 10:00", false},
+    {"0 9-17/2 * * *", "2026-10-19 11:00", true},
+    {"0 9-17/2 * * *", "2026-10-19 12:00", false},
+    {"0 9-17/2 * * *", "2026-10-19 19:00", false},
+    {"1,2,30-31 * * * *", "2026-10-19 10:02", true},
+    {"1,2,30-31 * * * *", "2026-10-19 10:31", true},
+    {"1,2,30-31 * * * *", "2026-10-19 10:03", false},
+    {"0 0 * 10 *", "2026-10-19 00:00", true},
+    {"0 0 * 11 *", "2026-10-19 00:00", false},
+    // 日和周都不是*时满足其中一个即可
+    {"0 0 1 * 1", "2026-10-19 00:00", true},
+    {"0 0 1 * 1", "2026-11-01 00:00", true},
+    {"0 0 1 * 1", "2026-10-20 00:00", false},
+    // 其中一个是*时需要同时满足
+    {"0 0 1 * *", "2026-10-19 00:00", false},
+    {"0 0 * * 1", "2026-10-19 00:00", true},
+    {"0 0 * * 1", "2026-10-20 00:00", false},
+    // */2也算*，需要同时满足（19号是单数）
+    {"0 0 */2 * 1", "2026-10-19 00:00", true},
+    {"0 0 */2 * 1", "2026-10-26 00:00", false},
+    {"0 0 1 * */3", "2026-10-20 00:00", false},
+    // 0和7都是周日
+    {"0 0 * * 7", "2026-11-01 00:00", true},
+    {"0 0 * * 0", "2026-11-01 00:00", true},
+    {"0 0 * * 5-7", "2026-11-01 00:00", true},
+    {"0 0 * * 5-7", "2026-10-19 00:00", false},
+  }
+  for _, c := range cases {
+    expr, e := parseCron(c.expr)
+    if e != nil {
+      t.Fatalf("%q: %s", c.expr, e)
+    }
+    if got := expr.match(shTime(c.t)); got != c.want {
+      t.Errorf("%q at %s: got %v, want %v", c.expr, c.t, got, c.want)
+    }
+  }
+}
@@ -1,159 +1,196 @@
 package main
 
 import (
-  "database/sql"
-  "encoding/json"
-  "fmt"
   "strconv"
   "time"
 
   "github.com/kwf2030/commons/times"
-  "github.com/rs/xid"
 )
 
-func putRunnerJob() {
-  arr1 := checkMsg(Conf.Task.Overload)
-  arr2 := checkProduct(Conf.Task.Overload - len(arr1))
-  payloads := make([]*Payload, 0, Conf.Task.Overload)
-  for _, v := range arr1 {
-    payloads = append(payloads, v)
-  }
-  for _, v := range arr2 {
-    payloads = append(payloads, v)
+const (
+  // 检查商品时每页的最小数量，受限的商品较多时减少查询次数
+  checkPageSize = 200
+  // 每次检查商品最多查询的页数，避免每次都扫描整个product表
+  checkMaxPages = 10
+)
+
+// 分发新消息（用户分享的商品链接）
+func dispatchMsgs() {
+  priority := Conf.Beanstalk.PutTubePriority
+  if Conf.Priority.Enabled {
+    priority = jobPriority(msgScore())
+  }
+  payloads, last := checkMsg(Conf.Task.Overload)
+  putRunnerJob(Conf.Beanstalk.PutTubeTask, payloads, priority, last)
+}
+
+// 分发需要更新的商品，按来源分别发布到各自的tube，
+// 距离上次分发还不到interval的来源不参与检查，避免它的商品占满检查的范围，
+// 按分数选择时，没有选中的商品等下一轮检查（仍然是待分发状态）
+func dispatchProducts() {
+  now := times.Now()
+  excluded := limitedSources(now)
+  if len(excluded) > 0 {
+    logger.Debug().Msgf("sources %v are limited, skip", excluded)
+  }
+  rl := loadRateLimiter()
+  defer rl.save()
+  var arr []*scoredPayload
+  if Conf.Priority.Enabled {
+    n := Conf.Priority.Candidates
+    if n < 1 {
+      n = 1
+    }
+    candidates := checkProduct(Conf.Task.Overload*n, excluded, rl)
+    arr = rankProducts(candidates, Conf.Task.Overload)
+    // 没有选中的商品退还令牌
+    selected := make(map[uint64]struct{}, len(arr))
+    for _, v := range arr {
+      selected[v.payload.Product.AID] = struct{}{}
+    }
+    for _, v := range candidates {
+      if _, ok := selected[v.Product.AID]; !ok {
+        rl.refund(v.Product)
+      }
+    }
+  } else {
+    for _, v := range checkProduct(Conf.Task.Overload, excluded, rl) {
+      arr = append(arr, &scoredPayload{payload: &Payload{Product: runnerProduct(v.Product)}})
+    }
   }
-  if len(payloads) == 0 {
+  if len(arr) == 0 {
     logger.Debug().Msg("no data to dispatch")
     return
   }
-  now := times.Now()
-  tid := xid.New().String()
-  t := &Task{
-    ID:         tid,
-    CreateTime: now,
-    Payloads:   payloads,
-  }
-  saveDispatchTime(arr2, now)
-  e := conn.Use(Conf.Beanstalk.PutTubeTask)
-  if e != nil {
-    logger.Error().Err(e).Msg("ERR: Use")
-    return
-  }
-  data, _ := json.Marshal(t)
-  dump(fmt.Sprintf("%s/dump/%s_runner.json", Conf.Log.Dir, tid), data)
-  _, e = conn.Put(Conf.Beanstalk.PutTubePriority, Conf.Beanstalk.PutTubeDelay, Conf.Beanstalk.PutTubeTTR, data)
-  if e != nil {
-    logger.Error().Err(e).Msg("ERR: Put")
-    return
+  sources, m := groupBySource(arr)
+  for _, source := range sources {
+    sc := sourceConf(source)
+    group := m[source]
+    batch := sc.Overload
+    if Conf.Priority.Enabled && Conf.Priority.Batch > 0 && Conf.Priority.Batch < batch {
+      batch = Conf.Priority.Batch
+    }
+    for i := 0; i < len(group); i += batch {
+      j := i + batch
+      if j > len(group) {
+        j = len(group)
+      }
+      payloads := make([]*Payload, 0, j-i)
+      for _, v := range group[i:j] {
+        payloads = append(payloads, v.payload)
+      }
+      priority := Conf.Beanstalk.PutTubePriority
+      if Conf.Priority.Enabled {
+        priority = jobPriority(group[i].score)
+      }
+      if putRunnerJob(sc.Tube, payloads, priority, 0) != "" {
+        markSourcePut(source, now)
+        continue
+      }
+      // 发布失败，商品等下一轮检查，退还令牌
+      for _, v := range payloads {
+        rl.refund(v.Product)
+      }
+    }
   }
-  logger.Info().Msgf("put runner job, ok, dispatch %d items, task id=%s", len(payloads), tid)
 }
 
-func checkMsg(limit int) []*Payload {
+// 返回需要分发的消息和检查到的最后一条消息的_id，
+// 消息游标在任务发布成功后才保存
+func checkMsg(limit int) ([]*Payload, uint64) {
   if limit <= 0 {
-    return nil
+    return nil, 0
   }
-  ret := make([]*Payload, 0, limit)
-  rows, e := db.Query(`SELECT _id, id, type, content, url FROM msg WHERE _id>? AND (type=1 OR type=49) LIMIT ?`, lastCheckMsg, limit)
+  arr, e := store.NextMessages(lastCheckMsg, limit)
   if e != nil {
-    return nil
+    logger.Error().Err(e).Msg("ERR: NextMessages")
   }
-  defer rows.Close()
+  ret := make([]*Payload, 0, limit)
   var aid uint64
-  var msgType int
-  for rows.Next() {
-    msg := &Message{}
-    e := rows.Scan(&aid, &msg.ID, &msgType, &msg.Content, &msg.URL)
-    if e != nil || (msg.Content == "" && msg.URL == "") {
+  for _, v := range arr {
+    aid = v.AID
+    msg := v.Msg
+    if msg.Content == "" && msg.URL == "" {
       continue
     }
     // 如果是分享且URL有值的话，删掉Content减少传输量
-    if msgType == MsgLink && msg.URL != "" {
+    if v.Type == MsgLink && msg.URL != "" {
       msg.Content = ""
     }
     ret = append(ret, &Payload{Message: msg})
   }
-  if aid > 0 {
-    saveLastCheckMsg(aid)
-  }
   logger.Debug().Msg("check msg, ok")
-  return ret
+  return ret, aid
 }
 
-func checkProduct(limit int) []*Payload {
+// 商品按last_dispatch_time从早到晚轮转，分发后last_dispatch_time更新为当前时间，
+// 排到最后，所以每个商品都会在一轮内被检查到，不需要保存游标，
+// 来源在excludeSources中的商品不检查，
+// 同一来源+域名的商品受rl限制，超出的商品跳过（仍然是待分发状态，下次优先检查），
+// 令牌桶用完的来源+域名从之后的查询中排除，避免受限的商品占满每次检查的范围，
+// 一直往后检查直到数量足够、没有待分发的商品或者查询了checkMaxPages页
+func checkProduct(limit int, excludeSources []int, rl *rateLimiter) []*Payload {
   if limit <= 0 {
     return nil
   }
-  tx, _ := db.Begin()
-  defer tx.Rollback()
-  ret := make([]*Payload, 0, limit)
-  var stmt, dt string
-  var rows, rows2 *sql.Rows
-  var e error
-  if Conf.Task.DispatchDuration <= 0 {
-    stmt = `SELECT _id, id, url FROM product WHERE _id>? LIMIT ?`
-    rows, e = tx.Query(stmt, lastCheckProduct, limit)
-  } else {
-    dt = times.Now().Add(time.Minute * time.Duration(-Conf.Task.DispatchDuration)).Format(times.DateTimeSFormat)
-    stmt = `SELECT _id, id, url FROM product WHERE _id>? AND last_dispatch_time<? LIMIT ?`
-    rows, e = tx.Query(stmt, lastCheckProduct, dt, limit)
+  // 按商品计算分发时间时，只要求最近min_interval内没有分发过，
+  // 避免抓取结果还没返回时重复分发
+  var dt, due time.Time
+  if Conf.Adaptive.Enabled {
+    min, _ := adaptiveIntervals()
+    due = times.Now()
+    dt = due.Add(-min)
+  } else if Conf.Task.DispatchDuration > 0 {
+    dt = times.Now().Add(time.Minute * time.Duration(-Conf.Task.DispatchDuration))
   }
-  if e != nil {
-    return nil
+  size := limit
+  if size < checkPageSize {
+    size = checkPageSize
   }
-  defer rows.Close()
-  var aid uint64
-  for rows.Next() {
-    p := &Product{}
-    e := rows.Scan(&p.AID, &p.ID, &p.URL)
-    if e != nil || p.URL == "" {
-      continue
+  ret := make([]*Payload, 0, limit)
+  limited := 0
+  excludeHosts := rl.empty(times.Now())
+  excluded := make(map[SourceHost]struct{}, len(excludeHosts))
+  for _, v := range excludeHosts {
+    excluded[v] = struct{}{}
+  }
+  var after *Product
+  for page := 0; page < checkMaxPages && len(ret) < limit; page++ {
+    arr, e := store.NextProductsDue(after, dt, due, excludeSources, excludeHosts, size)
+    if e != nil {
+      logger.Error().Err(e).Msg("ERR: NextProductsDue")
+      break
     }
-    aid = p.AID
-    ret = append(ret, &Payload{Product: p})
-  }
-  if aid > 0 {
-    saveLastCheckProduct(aid)
-  }
-  l := len(ret)
-  if l >= limit {
-    return ret
-  }
-
-  n := countProduct() - l
-  lm := limit - l
-  if lm > n {
-    lm = n
-  }
-  if Conf.Task.DispatchDuration <= 0 {
-    rows2, e = tx.Query(stmt, 0, lm)
-  } else {
-    rows2, e = tx.Query(stmt, 0, dt, lm)
-  }
-  if e != nil {
-    return ret
-  }
-  defer rows2.Close()
-  aid = 0
-  for rows2.Next() {
-    p := &Product{}
-    e := rows2.Scan(&p.AID, &p.ID, &p.URL)
-    if e != nil || p.URL == "" {
-      continue
+    for _, p := range arr {
+      if len(ret) >= limit {
+        break
+      }
+      after = p
+      if !rl.allow(p, times.Now()) {
+        limited++
+        sh := SourceHost{Source: p.Source, Host: productHost(p)}
+        if _, ok := excluded[sh]; !ok && sh.Host != "" {
+          excluded[sh] = struct{}{}
+          excludeHosts = append(excludeHosts, sh)
+        }
+        continue
+      }
+      ret = append(ret, &Payload{Product: p})
+    }
+    if len(arr) < size {
+      break
     }
-    aid = p.AID
-    ret = append(ret, &Payload{Product: p})
   }
-  if aid > 0 {
-    saveLastCheckProduct(aid)
+  if limited > 0 {
+    logger.Info().Msgf("check product, %d items are rate limited", limited)
   }
   logger.Debug().Msg("check product, ok")
   return ret
 }
 
-func countProduct() int {
-  ret := -1
-  db.QueryRow(`SELECT COUNT(_id) FROM product`).Scan(&ret)
-  return ret
+// 发给runner的商品只需要_id/id/url/source
+func runnerProduct(p *Product) *Product {
+  return &Product{AID: p.AID, ID: p.ID, URL: p.URL, Source: p.Source}
 }
 
 func saveLastCheckMsg(aid uint64) {
@@ -161,16 +198,16 @@ func saveLastCheckMsg(aid uint64) {
   kv.UpdateV(bucketVar, lastCheckMsgKey, []byte(strconv.FormatUint(aid, 10)))
 }
 
-func saveLastCheckProduct(aid uint64) {
-  lastCheckProduct = aid
-  kv.UpdateV(bucketVar, lastCheckProductKey, []byte(strconv.FormatUint(aid, 10)))
-}
-
-func saveDispatchTime(arr []*Payload, t time.Time) {
-  tx, _ := db.Begin()
-  defer tx.Commit()
-  str := t.Format(times.DateTimeSFormat)
+// 所有商品的last_dispatch_time在一个事务中更新，失败时全部回滚
+func saveDispatchTime(arr []*Payload, t time.Time) error {
+  if len(arr) == 0 {
+    return nil
+  }
+  aids := make([]uint64, 0, len(arr))
   for _, v := range arr {
-    tx.Exec(`UPDATE product SET last_dispatch_time=? WHERE _id=?`, str, v.Product.AID)
+    aids = append(aids, v.Product.AID)
   }
+  return store.Tx(func(s Store) error {
+    return s.SaveDispatchTime(aids, t)
+  })
 }
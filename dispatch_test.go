@@ -0,0 +1,162 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+)
+
+// 取出tube中所有的任务，返回每个任务的商品数
+func drainTube(t *testing.T, q Queue, tube string) []int {
+  ret := make([]int, 0, 4)
+  for {
+    job, e := q.Reserve(tube, 0)
+    if e == ErrReserveTimeout {
+      return ret
+    }
+    if e != nil {
+      t.Fatal(e)
+    }
+    task := &Task{}
+    if e := json.Unmarshal(job.Body, task); e != nil {
+      t.Fatal(e)
+    }
+    ret = append(ret, len(task.Payloads))
+    q.Ack(job)
+  }
+}
+
+func addDueProducts(s *memoryStore, source, n int, host string, t time.Time) {
+  for i := 0; i < n; i++ {
+    id := fmt.Sprintf("s%d_%s_%d", source, host, i)
+    s.RecordProductUpdate(&Product{ID: id, URL: fmt.Sprintf("https://%s/%d", host, i), Source: source, Price: 1, UpdateTime: t.Add(time.Second * time.Duration(i))})
+  }
+}
+
+func setDispatchConf(sources ...*SourceConf) func() {
+  old := *Conf
+  Conf.Task.Overload = 10
+  Conf.Task.DispatchDuration = 0
+  Conf.Adaptive.Enabled = false
+  Conf.Priority.Enabled = false
+  Conf.Beanstalk.PutTubeTask = "task"
+  Conf.Beanstalk.PutTubeTTR = 60
+  Conf.Sources = sources
+  sourceLastPut = make(map[int]time.Time, 8)
+  return func() {
+    *Conf = old
+  }
+}
+
+// 一个来源受interval限制时，不能影响其他来源的分发
+func TestDispatchLimitedSource(t *testing.T) {
+  defer newTestKV(t)()
+  defer setDispatchConf(&SourceConf{Source: 1, Tube: "t1", Interval: 3600}, &SourceConf{Source: 2, Tube: "t2"})()
+  s := newTestStore()
+  q := newTestQueue()
+  t0 := times.Now().Add(-time.Hour)
+  // 来源1的商品更早，排在前面
+  addDueProducts(s, 1, 20, "a.com", t0)
+  addDueProducts(s, 2, 5, "b.com", t0.Add(time.Minute))
+
+  dispatchProducts()
+  if got := drainTube(t, q, "t1"); len(got) != 1 || got[0] != 10 {
+    t.Fatalf("first dispatch, source 1: %v", got)
+  }
+  if got := drainTube(t, q, "t2"); len(got) != 0 {
+    t.Fatalf("first dispatch, source 2: %v", got)
+  }
+
+  dispatchProducts()
+  if got := drainTube(t, q, "t1"); len(got) != 0 {
+    t.Fatalf("second dispatch, source 1: %v", got)
+  }
+  if got := drainTube(t, q, "t2"); len(got) != 1 || got[0] != 5 {
+    t.Fatalf("second dispatch, source 2: %v", got)
+  }
+}
+
+// 受限的商品排在前面时，不能影响其他来源+域名的分发
+func TestDispatchRateLimited(t *testing.T) {
+  defer newTestKV(t)()
+  defer setDispatchConf(&SourceConf{Source: 1, Tube: "t1", Rate: 1, Burst: 2}, &SourceConf{Source: 2, Tube: "t2"})()
+  s := newTestStore()
+  q := newTestQueue()
+  t0 := times.Now().Add(-time.Hour)
+  addDueProducts(s, 1, 500, "a.com", t0)
+  addDueProducts(s, 2, 5, "b.com", t0.Add(time.Hour))
+
+  dispatchProducts()
+  if got := drainTube(t, q, "t1"); len(got) != 1 || got[0] != 2 {
+    t.Fatalf("source 1: %v", got)
+  }
+  if got := drainTube(t, q, "t2"); len(got) != 1 || got[0] != 5 {
+    t.Fatalf("source 2: %v", got)
+  }
+}
+
+type failQueue struct {
+  Queue
+}
+
+func (q *failQueue) Publish(tube string, priority, delay, ttr int, data []byte) (string, error) {
+  return "", fmt.Errorf("publish failed")
+}
+
+// 发布失败时退还令牌
+func TestDispatchRefundOnFailure(t *testing.T) {
+  defer newTestKV(t)()
+  defer setDispatchConf(&SourceConf{Source: 1, Tube: "t1", Rate: 0.001, Burst: 3})()
+  s := newTestStore()
+  queue = &failQueue{newMemoryQueue()}
+  addDueProducts(s, 1, 5, "a.com", times.Now().Add(-time.Hour))
+
+  dispatchProducts()
+  b := loadRateLimiter().buckets["1/a.com"]
+  if b == nil || b.Tokens < 2.99 {
+    t.Fatalf("tokens not refunded: %+v", b)
+  }
+  // 商品仍然是待分发状态
+  arr, _ := s.NextProductsDue(nil, times.Now().Add(-time.Minute), time.Time{}, nil, nil, 10)
+  if len(arr) != 5 {
+    t.Fatalf("due products: %d", len(arr))
+  }
+}
+
+type countingStore struct {
+  *memoryStore
+  n int
+}
+
+func (s *countingStore) NextProductsDue(after *Product, before, due time.Time, excludeSources []int, excludeHosts []SourceHost, limit int) ([]*Product, error) {
+  s.n++
+  return s.memoryStore.NextProductsDue(after, before, due, excludeSources, excludeHosts, limit)
+}
+
+// 令牌桶用完的域名从查询中排除，不需要扫描它的所有商品
+func TestCheckProductExcludeHosts(t *testing.T) {
+  defer newTestKV(t)()
+  defer setDispatchConf(&SourceConf{Source: 1, Tube: "t1", Rate: 1, Burst: 2})()
+  s := newTestStore()
+  t0 := times.Now().Add(-time.Hour)
+  addDueProducts(s, 1, 3000, "a.com", t0)
+  addDueProducts(s, 1, 5, "b.com", t0.Add(time.Hour))
+  cs := &countingStore{memoryStore: s}
+  store = cs
+
+  rl := loadRateLimiter()
+  arr := checkProduct(10, nil, rl)
+  if len(arr) != 4 || cs.n != 2 {
+    t.Fatalf("first check: %d products, %d queries", len(arr), cs.n)
+  }
+
+  // 两个域名的令牌都用完，第一次查询就排除
+  cs.n = 0
+  arr = checkProduct(10, nil, rl)
+  if len(arr) != 0 || cs.n != 1 {
+    t.Fatalf("second check: %d products, %d queries", len(arr), cs.n)
+  }
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+  "go.etcd.io/bbolt"
+)
+
+const (
+  FailureRelease = "release"
+  FailureBury    = "bury"
+)
+
+var bucketFailure = []byte("failure")
+
+// 没有配置failure_retention时失败记录保留的时间
+const defaultFailureRetention = time.Hour * 72
+
+// report任务处理失败的记录，保存在bolt的failure bucket，
+// key是时间+任务ID，便于按时间顺序查看，保留failure_retention小时后删除
+type Failure struct {
+  JobID    string    `json:"job_id"`
+  TaskID   string    `json:"task_id,omitempty"`
+  Tube     string    `json:"tube"`
+  Action   string    `json:"action"`
+  Attempts int       `json:"attempts"`
+  Delay    int       `json:"delay,omitempty"`
+  Reason   string    `json:"reason"`
+  Time     time.Time `json:"time"`
+}
+
+// 任务处理失败，没有超过最大尝试次数时延迟重试，否则bury，
+// permanent为true表示重试也不会成功（如JSON格式错误），直接bury
+func failJob(q Queue, job *Job, taskID string, reason error, permanent bool) {
+  f := &Failure{
+    JobID:    job.ID,
+    TaskID:   taskID,
+    Tube:     job.Tube,
+    Attempts: job.Releases + 1,
+    Reason:   reason.Error(),
+    Time:     times.Now(),
+  }
+  var e error
+  if permanent || f.Attempts >= Conf.Retry.MaxAttempts {
+    f.Action = FailureBury
+    e = q.Bury(job, Conf.Beanstalk.PutTubePriority)
+  } else {
+    f.Action = FailureRelease
+    f.Delay = retryDelay(job.Releases)
+    e = q.Nack(job, Conf.Beanstalk.PutTubePriority, f.Delay)
+  }
+  if e != nil {
+    logger.Error().Err(e).Msgf("ERR: %s", f.Action)
+  }
+  metricJobsFailed.Inc(f.Action)
+  logger.Warn().Msgf("job failed, %s, job id=%s, task id=%s, attempts=%d, reason=%s", f.Action, f.JobID, f.TaskID, f.Attempts, f.Reason)
+  saveFailure(f)
+}
+
+// 第n次重试的延迟时间（秒），指数增长
+func retryDelay(n int) int {
+  d := Conf.Retry.Delay
+  if d <= 0 {
+    return 0
+  }
+  for i := 0; i < n; i++ {
+    d *= 2
+    if Conf.Retry.MaxDelay > 0 && d >= Conf.Retry.MaxDelay {
+      return Conf.Retry.MaxDelay
+    }
+  }
+  return d
+}
+
+func saveFailure(f *Failure) {
+  data, _ := json.Marshal(f)
+  k := fmt.Sprintf("%s_%s", f.Time.Format(times.DateTimeSFormat3), f.JobID)
+  e := kv.UpdateV(bucketFailure, []byte(k), data)
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: saveFailure")
+  }
+}
+
+// 删除超过保留时间的失败记录，key以时间开头，按顺序删除到第一个没有过期的记录
+func pruneFailures() {
+  d := time.Hour * time.Duration(Conf.Retry.FailureRetention)
+  if d <= 0 {
+    d = defaultFailureRetention
+  }
+  before := []byte(times.Now().Add(-d).Format(times.DateTimeSFormat3))
+  n := 0
+  e := kv.UpdateB(bucketFailure, func(b *bbolt.Bucket) error {
+    // 遍历时删除会跳过下一个key，先收集再删除
+    keys := make([][]byte, 0, 16)
+    c := b.Cursor()
+    for k, _ := c.First(); k != nil && bytes.Compare(k, before) < 0; k, _ = c.Next() {
+      keys = append(keys, append([]byte(nil), k...))
+    }
+    for _, k := range keys {
+      if e := b.Delete(k); e != nil {
+        return e
+      }
+    }
+    n = len(keys)
+    return nil
+  })
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: pruneFailures")
+    return
+  }
+  if n > 0 {
+    logger.Info().Msgf("prune failures, ok, %d removed", n)
+  }
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+  "testing"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+)
+
+func TestPruneFailures(t *testing.T) {
+  defer newTestKV(t)()
+  old := Conf.Retry.FailureRetention
+  defer func() { Conf.Retry.FailureRetention = old }()
+  Conf.Retry.FailureRetention = 24
+  now := times.Now()
+  for i, d := range []time.Duration{-time.Hour * 50, -time.Hour * 30, -time.Hour * 25, -time.Hour, 0} {
+    saveFailure(&Failure{JobID: string('a' + rune(i)), Time: now.Add(d)})
+  }
+  pruneFailures()
+  n := 0
+  kv.EachKV(bucketFailure, func(k, v []byte, i int) error {
+    n++
+    return nil
+  })
+  if n != 2 {
+    t.Fatalf("%d failures left", n)
+  }
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+  "encoding/json"
+  "net/http"
+  "sync"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+  "go.etcd.io/bbolt"
+)
+
+var (
+  // 每个循环（商品分发、消息分发、inflight检查和每个worker）最近一次循环的记录
+  ticksL = &sync.Mutex{}
+  ticks  = make(map[string]*loopTick, 8)
+)
+
+type loopTick struct {
+  last time.Time
+  // 预计的下次循环时间（按循环自己的间隔，包括暂停的时间）
+  next time.Time
+}
+
+// 循环name开始一次循环或者开始等待，d是预计多久后再次循环（正在执行时为0）
+func tick(name string, d time.Duration) {
+  now := time.Now()
+  ticksL.Lock()
+  ticks[name] = &loopTick{last: now, next: now.Add(d)}
+  ticksL.Unlock()
+}
+
+func initHealth() {
+  if !Conf.Health.Enabled {
+    return
+  }
+  handleHTTP(Conf.Health.Listen, "/healthz", healthzHandler)
+  handleHTTP(Conf.Health.Listen, "/readyz", readyzHandler)
+}
+
+// 进程存活，并且每个循环超过预计的下次循环时间都不到max_tick_age秒
+// （卡在数据库或者队列调用中的循环不会再更新）
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+  now := time.Now()
+  maxAge := time.Second * time.Duration(Conf.Health.MaxTickAge)
+  ok := true
+  loops := make(map[string]interface{}, 8)
+  ticksL.Lock()
+  for name, t := range ticks {
+    stale := maxAge > 0 && now.Sub(t.next) > maxAge
+    if stale {
+      ok = false
+    }
+    loops[name] = map[string]interface{}{
+      "ok":        !stale,
+      "last_tick": t.last.In(times.TimeZoneSH).Format(times.DateTimeSFormat),
+    }
+  }
+  ticksL.Unlock()
+  writeHealth(w, ok, map[string]interface{}{"ok": ok, "loops": loops})
+}
+
+// 数据库、队列和bolt都可用
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+  checks := map[string]string{
+    "database": "ok",
+    "queue":    "ok",
+    "bolt":     "ok",
+  }
+  ok := true
+  if e := store.Ping(); e != nil {
+    checks["database"] = e.Error()
+    ok = false
+  }
+  if e := queue.Ping(); e != nil {
+    checks["queue"] = e.Error()
+    ok = false
+  }
+  if e := kv.Query(func(tx *bbolt.Tx) error { return nil }); e != nil {
+    checks["bolt"] = e.Error()
+    ok = false
+  }
+  writeHealth(w, ok, map[string]interface{}{"ok": ok, "checks": checks})
+}
+
+func writeHealth(w http.ResponseWriter, ok bool, m map[string]interface{}) {
+  data, _ := json.Marshal(m)
+  w.Header().Set("Content-Type", "application/json; charset=utf-8")
+  if !ok {
+    w.WriteHeader(http.StatusServiceUnavailable)
+  }
+  w.Write(data)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+func TestHealthz(t *testing.T) {
+  old := Conf.Health.MaxTickAge
+  defer func() {
+    Conf.Health.MaxTickAge = old
+    ticks = make(map[string]*loopTick, 8)
+  }()
+  Conf.Health.MaxTickAge = 60
+  ticks = make(map[string]*loopTick, 8)
+  now := time.Now()
+  cases := []struct {
+    name string
+    t    *loopTick
+    want int
+  }{
+    {"worker 0", &loopTick{last: now, next: now.Add(time.Second * 5)}, http.StatusOK},
+    // 暂停期间很久没有循环，但还没到下次循环的时间
+    {"dispatch product", &loopTick{last: now.Add(-time.Hour * 10), next: now.Add(time.Hour)}, http.StatusOK},
+    // 开始执行后卡住
+    {"check inflight", &loopTick{last: now.Add(-time.Minute * 5), next: now.Add(-time.Minute * 5)}, http.StatusServiceUnavailable},
+  }
+  for _, c := range cases {
+    ticks[c.name] = c.t
+    w := httptest.NewRecorder()
+    healthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+    if w.Code != c.want {
+      t.Errorf("%s: got %d, want %d, %s", c.name, w.Code, c.want, w.Body.String())
+    }
+  }
+}
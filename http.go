@@ -0,0 +1,36 @@
+package main
+
+import (
+  "net/http"
+  "time"
+)
+
+// 每个监听地址一个ServeMux，多个功能（metrics等）可以共用一个地址
+var httpMuxes = make(map[string]*http.ServeMux, 2)
+
+func handleHTTP(addr, path string, f http.HandlerFunc) {
+  mux, ok := httpMuxes[addr]
+  if !ok {
+    mux = http.NewServeMux()
+    httpMuxes[addr] = mux
+  }
+  mux.HandleFunc(path, f)
+}
+
+func startHTTP() {
+  for addr, mux := range httpMuxes {
+    srv := &http.Server{
+      Addr:         addr,
+      Handler:      mux,
+      ReadTimeout:  time.Second * 10,
+      WriteTimeout: time.Second * 10,
+    }
+    go func() {
+      logger.Info().Msgf("http listen on %s", srv.Addr)
+      e := srv.ListenAndServe()
+      if e != nil && e != http.ErrServerClosed {
+        logger.Error().Err(e).Msg("ERR: ListenAndServe")
+      }
+    }()
+  }
+}
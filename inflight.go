@@ -0,0 +1,286 @@
+package main
+
+import (
+  "encoding/json"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+  "go.etcd.io/bbolt"
+)
+
+const (
+  InflightDispatched = "dispatched"
+  InflightReported   = "reported"
+  InflightTimeout    = "timeout"
+)
+
+// 检查超时任务的间隔
+const inflightCheckInterval = time.Minute
+
+var bucketInflight = []byte("inflight")
+
+// 已发布的抓取任务，保存在bolt的inflight bucket，key是任务ID，
+// 收到report时记录返回时间，超过Deadline没有返回时检查任务在队列中的状态，
+// 任务已经删除（runner处理完但report丢失）或者被bury时商品放回轮转，消息重新分发，
+// 还在队列中时（等待runner处理或者正在处理，超过TTR时beanstalk会自动放回队列）推迟Deadline，
+// 记录保留audit_retention小时后删除，可以作为每个任务的处理记录
+type InflightTask struct {
+  ID         string     `json:"id"`
+  JobID      string     `json:"job_id,omitempty"`
+  Tube       string     `json:"tube"`
+  Priority   int        `json:"priority"`
+  State      string     `json:"state"`
+  CreateTime time.Time  `json:"create_time"`
+  Deadline   time.Time  `json:"deadline"`
+  ReportTime time.Time  `json:"report_time,omitempty"`
+  Payloads   []*Payload `json:"payloads"`
+  // 超时后重新分发消息的任务ID（商品放回轮转，不单独分发）
+  Redispatch string `json:"redispatch,omitempty"`
+  // 已经重试过report中失败的商品
+  Retried bool `json:"retried,omitempty"`
+}
+
+// 任务发布成功后开始跟踪
+func trackInflight(pt *PendingTask, jobID string) {
+  t := pt.Task
+  it := &InflightTask{
+    ID:         t.ID,
+    JobID:      jobID,
+    Tube:       pt.Tube,
+    Priority:   pt.Priority,
+    State:      InflightDispatched,
+    CreateTime: t.CreateTime,
+    Deadline:   t.CreateTime.Add(time.Second*time.Duration(pt.Delay) + inflightTTR()),
+    Payloads:   t.Payloads,
+  }
+  e := saveInflight(it)
+  if e != nil {
+    logger.Error().Err(e).Msgf("ERR: saveInflight, task id=%s", t.ID)
+    return
+  }
+  metricTasksInflight.Add(1)
+}
+
+// 收到report时调用，记录返回时间和耗时，返回任务发布时的记录（没有记录时为nil），
+// 同一个report重试时只记录第一次
+func reportInflight(taskID string) *InflightTask {
+  if taskID == "" {
+    return nil
+  }
+  now := times.Now()
+  var it *InflightTask
+  var latency time.Duration
+  var late bool
+  e := kv.UpdateB(bucketInflight, func(b *bbolt.Bucket) error {
+    v := b.Get([]byte(taskID))
+    if v == nil {
+      return nil
+    }
+    it = &InflightTask{}
+    if e := json.Unmarshal(v, it); e != nil {
+      it = nil
+      return e
+    }
+    if !it.ReportTime.IsZero() {
+      return nil
+    }
+    it.ReportTime = now
+    latency = now.Sub(it.CreateTime)
+    late = it.State == InflightTimeout
+    if !late {
+      it.State = InflightReported
+    }
+    data, _ := json.Marshal(it)
+    return b.Put([]byte(taskID), data)
+  })
+  if e != nil {
+    logger.Error().Err(e).Msgf("ERR: reportInflight, task id=%s", taskID)
+    return it
+  }
+  if latency <= 0 {
+    return it
+  }
+  metricTaskLatency.Observe(latency.Seconds())
+  if late {
+    logger.Warn().Msgf("task %s reported after timeout, latency %s", taskID, latency)
+    return it
+  }
+  metricTasksInflight.Add(-1)
+  return it
+}
+
+// 检查超过Deadline的任务，删除超过保留时间的记录
+func checkInflight() {
+  now := times.Now()
+  retention := time.Hour * time.Duration(Conf.Task.AuditRetention)
+  expired := make([]*InflightTask, 0, 4)
+  stale := make([]string, 0, 16)
+  e := kv.EachKV(bucketInflight, func(k, v []byte, n int) error {
+    it := &InflightTask{}
+    if json.Unmarshal(v, it) != nil {
+      stale = append(stale, string(k))
+      return nil
+    }
+    if it.State == InflightDispatched && now.After(it.Deadline) {
+      expired = append(expired, it)
+    } else if it.State != InflightDispatched && retention > 0 && now.Sub(it.CreateTime) > retention {
+      stale = append(stale, string(k))
+    }
+    return nil
+  })
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: EachKV")
+    return
+  }
+  n := 0
+  for _, it := range expired {
+    if checkExpired(it, now) {
+      n++
+    }
+  }
+  if len(stale) > 0 {
+    e = kv.UpdateB(bucketInflight, func(b *bbolt.Bucket) error {
+      for _, k := range stale {
+        if e := b.Delete([]byte(k)); e != nil {
+          return e
+        }
+      }
+      return nil
+    })
+    if e != nil {
+      logger.Error().Err(e).Msg("ERR: UpdateB")
+    }
+  }
+  logger.Debug().Msgf("check inflight, ok, %d expired, %d timed out, %d removed", len(expired), n, len(stale))
+}
+
+// 任务还在队列中时推迟Deadline，否则标记为超时并重新分发，返回是否重新分发，
+// 状态在一个事务中重新检查后修改，不会覆盖同时收到的report
+func checkExpired(it *InflightTask, now time.Time) bool {
+  if it.JobID != "" {
+    state, e := queue.JobState(it.JobID)
+    if e != nil && e != ErrJobNotFound {
+      logger.Error().Err(e).Msgf("ERR: JobState, task id=%s", it.ID)
+      return false
+    }
+    if e == nil && state != JobBuried {
+      _, e = updateInflight(it.ID, func(v *InflightTask) bool {
+        if v.State != InflightDispatched {
+          return false
+        }
+        v.Deadline = now.Add(inflightTTR())
+        return true
+      })
+      if e != nil {
+        logger.Error().Err(e).Msgf("ERR: updateInflight, task id=%s", it.ID)
+      }
+      logger.Debug().Msgf("task %s is %s, deadline extended", it.ID, state)
+      return false
+    }
+  }
+  // 标记后收到的report按超时后返回处理
+  it, e := updateInflight(it.ID, func(v *InflightTask) bool {
+    if v.State != InflightDispatched {
+      return false
+    }
+    v.State = InflightTimeout
+    return true
+  })
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: updateInflight")
+    return false
+  }
+  if it == nil {
+    return false
+  }
+  metricTasksTimedOut.Inc()
+  metricTasksInflight.Add(-1)
+  // 商品放回轮转（受来源的interval和令牌桶限制），消息重新发布
+  products := make([]*Product, 0, len(it.Payloads))
+  payloads := make([]*Payload, 0, 1)
+  for _, v := range it.Payloads {
+    if v.Product != nil && v.Product.AID != 0 {
+      products = append(products, v.Product)
+    } else if v.Message != nil {
+      payloads = append(payloads, &Payload{Message: v.Message})
+    }
+  }
+  e = requeueProducts(products, 0)
+  if e != nil {
+    logger.Error().Err(e).Msgf("ERR: requeueProducts, task id=%s", it.ID)
+  }
+  tid := putRunnerJob(it.Tube, payloads, it.Priority, 0)
+  logger.Warn().Msgf("task %s timed out, %d products requeued, %d msgs redispatched as %s", it.ID, len(products), len(payloads), tid)
+  if tid == "" {
+    return true
+  }
+  _, e = updateInflight(it.ID, func(v *InflightTask) bool {
+    v.Redispatch = tid
+    return true
+  })
+  if e != nil {
+    logger.Error().Err(e).Msgf("ERR: updateInflight, task id=%s", it.ID)
+  }
+  return true
+}
+
+// 启动时统计还没有返回的任务数
+func loadInflight() {
+  n := 0
+  kv.EachKV(bucketInflight, func(k, v []byte, _ int) error {
+    it := &InflightTask{}
+    if json.Unmarshal(v, it) == nil && it.State == InflightDispatched {
+      n++
+    }
+    return nil
+  })
+  metricTasksInflight.Set(float64(n))
+  logger.Info().Msgf("load inflight, ok, %d tasks", n)
+}
+
+func inflightInterval(last time.Time) time.Time {
+  return last.Add(inflightCheckInterval)
+}
+
+// 任务在队列中的TTR，从runner取走任务开始计算
+func inflightTTR() time.Duration {
+  ttr := Conf.Beanstalk.PutTubeTTR
+  if ttr <= 0 {
+    ttr = 1
+  }
+  return time.Second * time.Duration(ttr)
+}
+
+// 在一个事务中读取记录并用f修改，f返回false时不保存，
+// 返回保存后的记录，记录不存在或者没有保存时返回nil
+func updateInflight(id string, f func(it *InflightTask) bool) (*InflightTask, error) {
+  var ret *InflightTask
+  e := kv.UpdateB(bucketInflight, func(b *bbolt.Bucket) error {
+    v := b.Get([]byte(id))
+    if v == nil {
+      return nil
+    }
+    it := &InflightTask{}
+    if e := json.Unmarshal(v, it); e != nil {
+      return e
+    }
+    if !f(it) {
+      return nil
+    }
+    data, e := json.Marshal(it)
+    if e != nil {
+      return e
+    }
+    ret = it
+    return b.Put([]byte(id), data)
+  })
+  return ret, e
+}
+
+func saveInflight(it *InflightTask) error {
+  data, e := json.Marshal(it)
+  if e != nil {
+    return e
+  }
+  return kv.UpdateV(bucketInflight, []byte(it.ID), data)
+}
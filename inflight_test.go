@@ -0,0 +1,109 @@
+package main
+
+import (
+  "encoding/json"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+  "go.etcd.io/bbolt"
+)
+
+func getInflight(t *testing.T, id string) *InflightTask {
+  var ret *InflightTask
+  kv.QueryB(bucketInflight, func(b *bbolt.Bucket) error {
+    if v := b.Get([]byte(id)); v != nil {
+      ret = &InflightTask{}
+      return json.Unmarshal(v, ret)
+    }
+    return nil
+  })
+  if ret == nil {
+    t.Fatalf("inflight task %s not found", id)
+  }
+  return ret
+}
+
+// 把任务的Deadline改为已经过去
+func expireInflight(t *testing.T, id string) {
+  _, e := updateInflight(id, func(it *InflightTask) bool {
+    it.Deadline = times.Now().Add(-time.Second)
+    return true
+  })
+  if e != nil {
+    t.Fatal(e)
+  }
+}
+
+func TestCheckInflight(t *testing.T) {
+  defer newTestKV(t)()
+  defer setDispatchConf()()
+  Conf.Task.DispatchDuration = 60
+  s := newTestStore()
+  s.RecordProductUpdate(&Product{ID: "p1", URL: "https://a.com/1", Price: 1, UpdateTime: times.Now().Add(-time.Hour * 2)})
+  q := newTestQueue()
+  tid := putRunnerJob("t1", []*Payload{{Product: &Product{AID: 1, ID: "p1", URL: "https://a.com/1"}}}, 0, 0)
+  if tid == "" {
+    t.Fatal("put runner job failed")
+  }
+
+  // 还在队列中等待runner处理，不能重新分发
+  expireInflight(t, tid)
+  checkInflight()
+  it := getInflight(t, tid)
+  if it.State != InflightDispatched || !it.Deadline.After(times.Now()) {
+    t.Fatalf("ready task: %+v", it)
+  }
+
+  // runner正在处理
+  job, e := q.Reserve("t1", 0)
+  if e != nil {
+    t.Fatal(e)
+  }
+  expireInflight(t, tid)
+  checkInflight()
+  if it := getInflight(t, tid); it.State != InflightDispatched {
+    t.Fatalf("reserved task: %+v", it)
+  }
+
+  // runner删除了任务但是没有返回report
+  q.Ack(job)
+  expireInflight(t, tid)
+  checkInflight()
+  it = getInflight(t, tid)
+  if it.State != InflightTimeout {
+    t.Fatalf("lost task: %+v", it)
+  }
+  // 商品放回轮转，由下一次商品分发重新分发
+  if got := drainTube(t, q, "t1"); len(got) != 0 {
+    t.Fatalf("redispatched directly: %v", got)
+  }
+  dispatchProducts()
+  if got := drainTube(t, q, "task"); len(got) != 1 || got[0] != 1 {
+    t.Fatalf("redispatched: %v", got)
+  }
+}
+
+// 检查期间收到的report不能被覆盖
+func TestCheckExpiredReported(t *testing.T) {
+  defer newTestKV(t)()
+  defer setDispatchConf()()
+  newTestStore()
+  q := newTestQueue()
+  tid := putRunnerJob("t1", []*Payload{{Product: &Product{AID: 1, ID: "p1", URL: "https://a.com/1"}}}, 0, 0)
+  job, _ := q.Reserve("t1", 0)
+  q.Ack(job)
+  expireInflight(t, tid)
+  snapshot := getInflight(t, tid)
+
+  reportInflight(tid)
+  if checkExpired(snapshot, times.Now()) {
+    t.Fatal("reported task redispatched")
+  }
+  if it := getInflight(t, tid); it.State != InflightReported || it.Redispatch != "" {
+    t.Fatalf("reported task: %+v", it)
+  }
+  if got := drainTube(t, q, "t1"); len(got) != 0 {
+    t.Fatalf("redispatched: %v", got)
+  }
+}
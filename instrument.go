@@ -0,0 +1,189 @@
+package main
+
+import (
+  "time"
+)
+
+// 统计每个Store操作的耗时
+type metricsStore struct {
+  s Store
+}
+
+func (m *metricsStore) NextMessages(after uint64, limit int) ([]*MsgRecord, error) {
+  defer metricDBLatency.Since(time.Now(), "next_messages")
+  return m.s.NextMessages(after, limit)
+}
+
+func (m *metricsStore) NextProductsDue(after *Product, before, due time.Time, excludeSources []int, excludeHosts []SourceHost, limit int) ([]*Product, error) {
+  defer metricDBLatency.Since(time.Now(), "next_products_due")
+  return m.s.NextProductsDue(after, before, due, excludeSources, excludeHosts, limit)
+}
+
+func (m *metricsStore) SaveDispatchTime(aids []uint64, t time.Time) error {
+  defer metricDBLatency.Since(time.Now(), "save_dispatch_time")
+  return m.s.SaveDispatchTime(aids, t)
+}
+
+func (m *metricsStore) SaveNextDispatchTime(productID string, t time.Time) error {
+  defer metricDBLatency.Since(time.Now(), "save_next_dispatch_time")
+  return m.s.SaveNextDispatchTime(productID, t)
+}
+
+func (m *metricsStore) RecordProductFailure(productID string, maxFailures int) (int, bool, error) {
+  defer metricDBLatency.Since(time.Now(), "record_product_failure")
+  return m.s.RecordProductFailure(productID, maxFailures)
+}
+
+func (m *metricsStore) ReportTime(productID string) (time.Time, error) {
+  defer metricDBLatency.Since(time.Now(), "report_time")
+  return m.s.ReportTime(productID)
+}
+
+func (m *metricsStore) SaveReportTime(productID string, t time.Time) error {
+  defer metricDBLatency.Since(time.Now(), "save_report_time")
+  return m.s.SaveReportTime(productID, t)
+}
+
+func (m *metricsStore) ClearProductFailure(productID string) error {
+  defer metricDBLatency.Since(time.Now(), "clear_product_failure")
+  return m.s.ClearProductFailure(productID)
+}
+
+func (m *metricsStore) MessageSender(msgID string) (string, time.Time, error) {
+  defer metricDBLatency.Since(time.Now(), "message_sender")
+  return m.s.MessageSender(msgID)
+}
+
+func (m *metricsStore) UpsertWatch(userID string, p *Product, watchTime time.Time) error {
+  defer metricDBLatency.Since(time.Now(), "upsert_watch")
+  return m.s.UpsertWatch(userID, p, watchTime)
+}
+
+func (m *metricsStore) LatestUpdate(productID string) (*Product, error) {
+  defer metricDBLatency.Since(time.Now(), "latest_update")
+  return m.s.LatestUpdate(productID)
+}
+
+func (m *metricsStore) RecordProductUpdate(p *Product) error {
+  defer metricDBLatency.Since(time.Now(), "record_product_update")
+  return m.s.RecordProductUpdate(p)
+}
+
+func (m *metricsStore) GetProduct(productID string) (*Product, error) {
+  defer metricDBLatency.Since(time.Now(), "get_product")
+  return m.s.GetProduct(productID)
+}
+
+func (m *metricsStore) WatchersOf(productID string) ([]*ProductWatch, error) {
+  defer metricDBLatency.Since(time.Now(), "watchers_of")
+  return m.s.WatchersOf(productID)
+}
+
+func (m *metricsStore) WatchersOfProducts(productIDs []string) (map[string][]*ProductWatch, error) {
+  defer metricDBLatency.Since(time.Now(), "watchers_of_products")
+  return m.s.WatchersOfProducts(productIDs)
+}
+
+func (m *metricsStore) CountWatchers(productID string) (int, error) {
+  defer metricDBLatency.Since(time.Now(), "count_watchers")
+  return m.s.CountWatchers(productID)
+}
+
+func (m *metricsStore) UserLocales(userIDs []string) (map[string]string, error) {
+  defer metricDBLatency.Since(time.Now(), "user_locales")
+  return m.s.UserLocales(userIDs)
+}
+
+func (m *metricsStore) RecordNotifications(arr []*NotifyRecord) error {
+  defer metricDBLatency.Since(time.Now(), "record_notifications")
+  return m.s.RecordNotifications(arr)
+}
+
+func (m *metricsStore) NotifyStates(productID string) (map[string]map[string]*NotifyState, error) {
+  defer metricDBLatency.Since(time.Now(), "notify_states")
+  return m.s.NotifyStates(productID)
+}
+
+func (m *metricsStore) CountUpdates(productID string, since time.Time) (int, error) {
+  defer metricDBLatency.Since(time.Now(), "count_updates")
+  return m.s.CountUpdates(productID, since)
+}
+
+func (m *metricsStore) Tx(f func(s Store) error) error {
+  defer metricDBLatency.Since(time.Now(), "tx")
+  return m.s.Tx(func(s Store) error {
+    return f(&metricsStore{s: s})
+  })
+}
+
+func (m *metricsStore) Ping() error {
+  return m.s.Ping()
+}
+
+func (m *metricsStore) Close() error {
+  return m.s.Close()
+}
+
+// 统计每个Queue操作的错误数（不包括Reserve超时）
+type metricsQueue struct {
+  q Queue
+}
+
+func wrapQueue(q Queue) Queue {
+  if !Conf.Metrics.Enabled {
+    return q
+  }
+  return &metricsQueue{q: q}
+}
+
+func (m *metricsQueue) Reserve(tube string, timeout int) (*Job, error) {
+  job, e := m.q.Reserve(tube, timeout)
+  if e != nil && e != ErrReserveTimeout {
+    metricQueueErrors.Inc("reserve")
+  }
+  if job != nil {
+    metricJobsReserved.Inc()
+    metricLastReserve.Set(float64(time.Now().Unix()))
+  }
+  return job, e
+}
+
+func (m *metricsQueue) Ack(job *Job) error {
+  return m.count("ack", m.q.Ack(job))
+}
+
+func (m *metricsQueue) Nack(job *Job, priority, delay int) error {
+  return m.count("nack", m.q.Nack(job, priority, delay))
+}
+
+func (m *metricsQueue) Bury(job *Job, priority int) error {
+  return m.count("bury", m.q.Bury(job, priority))
+}
+
+func (m *metricsQueue) Publish(tube string, priority, delay, ttr int, data []byte) (string, error) {
+  id, e := m.q.Publish(tube, priority, delay, ttr, data)
+  return id, m.count("publish", e)
+}
+
+func (m *metricsQueue) JobState(id string) (string, error) {
+  state, e := m.q.JobState(id)
+  if e == ErrJobNotFound {
+    return state, e
+  }
+  return state, m.count("job_state", e)
+}
+
+func (m *metricsQueue) Ping() error {
+  return m.q.Ping()
+}
+
+func (m *metricsQueue) Close() error {
+  return m.q.Close()
+}
+
+func (m *metricsQueue) count(op string, e error) error {
+  if e != nil {
+    metricQueueErrors.Inc(op)
+  }
+  return e
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+  "time"
+)
+
+// 每次最多写入的notify_ledger记录数
+const ledgerBatchSize = 500
+
+func notifyCooldown(event string) time.Duration {
+  var n int
+  switch event {
+  case EventDecrease:
+    n = Conf.Notify.Cooldown.Decrease
+  case EventIncrease:
+    n = Conf.Notify.Cooldown.Increase
+  case EventRange:
+    n = Conf.Notify.Cooldown.Range
+  }
+  return time.Minute * time.Duration(n)
+}
+
+// 按通知记录判断是否不发送，返回原因（cooldown/not_new_low），发送时返回空字符串，
+// states是该用户在关注之后收到的通知（按事件类型）
+func suppressNotification(n *Notification, states map[string]*NotifyState, now time.Time) string {
+  st, ok := states[n.Event]
+  if !ok {
+    return ""
+  }
+  if cd := notifyCooldown(n.Event); cd > 0 && now.Sub(st.LastTime) < cd {
+    return "cooldown"
+  }
+  if n.Event == EventDecrease && Conf.Notify.NewLowOnly && n.Price >= st.LowestPrice {
+    return "not_new_low"
+  }
+  return ""
+}
+
+// 推送成功后记录，失败时只影响之后的去重
+func recordNotifications(arr []*Notification, t time.Time) {
+  records := make([]*NotifyRecord, 0, len(arr))
+  for _, n := range arr {
+    records = append(records, &NotifyRecord{
+      UserID:     n.UserID,
+      ProductID:  n.ProductID,
+      Event:      n.Event,
+      Currency:   n.Currency,
+      Price:      n.Price,
+      PriceLow:   n.PriceLow,
+      PriceHigh:  n.PriceHigh,
+      NotifyTime: t,
+    })
+  }
+  for i := 0; i < len(records); i += ledgerBatchSize {
+    j := i + ledgerBatchSize
+    if j > len(records) {
+      j = len(records)
+    }
+    e := store.RecordNotifications(records[i:j])
+    if e != nil {
+      logger.Error().Err(e).Msg("ERR: RecordNotifications")
+    }
+  }
+}
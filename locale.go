@@ -0,0 +1,103 @@
+package main
+
+import (
+  "fmt"
+  "math"
+  "strconv"
+  "strings"
+)
+
+const (
+  LocaleZhCN = "zh-CN"
+  LocaleEn   = "en"
+  LocaleJa   = "ja"
+)
+
+// 支持的语言，和模板目录下的子目录对应
+var locales = []string{LocaleZhCN, LocaleEn, LocaleJa}
+
+// 转换为支持的语言：完全匹配（不区分大小写，_和-等价），
+// 其次按语言部分匹配（如en-US->en，zh-TW->zh-CN），都不匹配时使用默认语言
+func normalizeLocale(locale string) string {
+  s := strings.Replace(strings.TrimSpace(locale), "_", "-", -1)
+  for _, v := range locales {
+    if strings.EqualFold(s, v) {
+      return v
+    }
+  }
+  lang := strings.ToLower(strings.SplitN(s, "-", 2)[0])
+  for _, v := range locales {
+    if lang != "" && strings.ToLower(strings.SplitN(v, "-", 2)[0]) == lang {
+      return v
+    }
+  }
+  return defaultLocale()
+}
+
+func defaultLocale() string {
+  s := strings.Replace(strings.TrimSpace(Conf.Notify.DefaultLocale), "_", "-", -1)
+  for _, v := range locales {
+    if strings.EqualFold(s, v) {
+      return v
+    }
+  }
+  return LocaleZhCN
+}
+
+// 按语言和币种格式化价格，
+// zh-CN保持原来的格式（￥12.50），en和ja按千分位分组，日元不保留小数
+func formatPrice(locale string, currency int, v float64) string {
+  if locale == LocaleZhCN {
+    return fmt.Sprintf(getCurrencyFormat(currency), v)
+  }
+  // 0:RMB, 1:JPY, 2:USD, 3:GBP, 4:EUR
+  decimals := 2
+  if currency == 1 {
+    decimals = 0
+  }
+  sign := ""
+  if v < 0 {
+    sign = "-"
+  }
+  n := groupDigits(math.Abs(v), decimals)
+  if locale == LocaleJa {
+    switch currency {
+    case 0:
+      return sign + n + "元"
+    case 1:
+      return sign + n + "円"
+    }
+  }
+  switch currency {
+  case 1:
+    return sign + "¥" + n
+  case 2:
+    return sign + "$" + n
+  case 3:
+    return sign + "£" + n
+  case 4:
+    return sign + "€" + n
+  }
+  return sign + "CN¥" + n
+}
+
+// 按千分位分组，如1234567.891->1,234,567.89
+func groupDigits(v float64, decimals int) string {
+  s := strconv.FormatFloat(math.Abs(v), 'f', decimals, 64)
+  frac := ""
+  if i := strings.IndexByte(s, '.'); i >= 0 {
+    s, frac = s[:i], s[i:]
+  }
+  b := &strings.Builder{}
+  if v < 0 {
+    b.WriteByte('-')
+  }
+  for i, c := range s {
+    if i > 0 && (len(s)-i)%3 == 0 {
+      b.WriteByte(',')
+    }
+    b.WriteRune(c)
+  }
+  b.WriteString(frac)
+  return b.String()
+}
@@ -8,9 +8,10 @@ import (
   "os/signal"
   "strconv"
   "strings"
+  "sync"
+  "syscall"
   "time"
 
-  "github.com/kwf2030/commons/beanstalk"
   "github.com/kwf2030/commons/boltdb"
   "github.com/kwf2030/commons/times"
   "github.com/rs/zerolog"
@@ -24,24 +25,24 @@ const Version = "1.0.1"
 var (
   bucketVar = []byte("var")
 
-  loopChan = make(chan struct{})
-
   logFile *os.File
   logger  *zerolog.Logger
 
-  db *sql.DB
-  kv *boltdb.KVStore
+  db    *sql.DB
+  store Store
+  kv    *boltdb.KVStore
 
   lastCheckMsgKey = []byte("last_check_msg")
   lastCheckMsg    uint64
 
-  lastCheckProductKey = []byte("last_check_product")
-  lastCheckProduct    uint64
-
-  conn *beanstalk.Conn
+  queue Queue
 )
 
 func main() {
+  if len(os.Args) >= 2 && os.Args[1] == "migrate" {
+    runMigrate(os.Args[2:])
+    return
+  }
   file := "conf.yaml"
   if len(os.Args) == 2 {
     file = os.Args[1]
@@ -55,23 +56,45 @@ func main() {
   defer logFile.Close()
   logger.Info().Msg("Hiprice Dispatcher " + Version)
 
-  initDB()
-  defer db.Close()
+  initTemplates()
+
+  initStore()
+  defer store.Close()
 
   initKV()
   defer kv.Close()
 
   loadVars()
 
-  initBeanstalk()
-  defer conn.Quit()
+  initSchedule()
+
+  initQueue()
+  defer queue.Close()
+
+  initMetrics()
+  initHealth()
+  startHTTP()
+
+  initWorkers()
+  defer closeWorkers()
+
+  go superviseDB()
+
+  loadInflight()
+  recoverPending()
+  recoverPendingMsgs(true)
 
   go run()
-  loopChan <- struct{}{}
 
   s := make(chan os.Signal, 1)
-  signal.Notify(s, os.Interrupt)
-  <-s
+  signal.Notify(s, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+  sig := <-s
+  for sig == syscall.SIGHUP {
+    reloadTemplates()
+    sig = <-s
+  }
+  logger.Info().Msgf("receive signal %s, shutting down", sig)
+  shutdown()
 }
 
 func initLogger() {
@@ -111,6 +134,7 @@ func initLogger() {
 }
 
 func initDB() {
+  ok := false
   for i := 0; i < 3; i++ {
     c := mysql.NewConfig()
     c.Net = "tcp"
@@ -131,20 +155,38 @@ func initDB() {
     }
     e = db.Ping()
     if e != nil {
+      db.Close()
       logger.Error().Err(e).Msg("database ping failed, will retry 10 seconds later")
       time.Sleep(time.Second * 10)
       continue
     }
+    ok = true
     break
   }
-  if db == nil {
+  if !ok {
     panic(errors.New("no database connection"))
   }
 }
 
+func initStore() {
+  if strings.ToLower(Conf.Database.Driver) != "memory" {
+    initDB()
+    n, e := migrateUp(db)
+    if e != nil {
+      panic(e)
+    }
+    logger.Info().Msgf("migrate, ok, %d migration(s) applied", n)
+  }
+  var e error
+  store, e = newStore()
+  if e != nil {
+    panic(e)
+  }
+}
+
 func initKV() {
   var e error
-  kv, e = boltdb.Open("dispatcher.db", "var")
+  kv, e = boltdb.Open("dispatcher.db", string(bucketVar), string(bucketFailure), string(bucketRateLimit), string(bucketOutbox), string(bucketInflight), string(bucketMsgOutbox))
   if e != nil {
     panic(e)
   }
@@ -156,61 +198,106 @@ func loadVars() {
     if len(v1) > 0 {
       lastCheckMsg, _ = strconv.ParseUint(string(v1), 10, 64)
     }
-    v2 := b.Get(lastCheckProductKey)
-    if len(v2) > 0 {
-      lastCheckProduct, _ = strconv.ParseUint(string(v2), 10, 64)
-    }
     return nil
   })
-  logger.Info().Msgf("last_check_msg=%d, last_check_product=%d", lastCheckMsg, lastCheckProduct)
+  logger.Info().Msgf("last_check_msg=%d", lastCheckMsg)
 }
 
-func initBeanstalk() {
+func initQueue() {
+  queue = connectQueue()
+  metricConnUp.Set(1, "queue")
+}
+
+// 连接队列，失败时30秒后重试，最多3次，都失败时panic
+func connectQueue() Queue {
   for i := 0; i < 3; i++ {
-    var e error
-    conn, e = beanstalk.Dial(Conf.Beanstalk.Host, Conf.Beanstalk.Port)
+    q, e := newQueue()
     if e != nil {
-      logger.Info().Msg("beanstalk connect failed, will retry 30 seconds later")
+      logger.Error().Err(e).Msg("queue connect failed, will retry 30 seconds later")
       time.Sleep(time.Second * 30)
       continue
     }
-    _, e = conn.Watch(Conf.Beanstalk.ReserveTube)
-    if e != nil {
-      panic(e)
-    }
-    break
+    return q
+  }
+  panic(errors.New("no queue connection"))
+}
+
+func initMetrics() {
+  if !Conf.Metrics.Enabled {
+    return
   }
+  store = &metricsStore{s: store}
+  queue = wrapQueue(queue)
+  path := Conf.Metrics.Path
+  if path == "" {
+    path = "/metrics"
+  }
+  handleHTTP(Conf.Metrics.Listen, path, metricsHandler)
 }
 
+// report消费、商品分发和消息分发互相独立：
+// worker一直阻塞取report任务，商品和消息按各自的间隔分发，并定时检查超时没有返回的任务
 func run() {
-  // 外层循环是定时任务
-  for range loopChan {
-    // 内层循环是一直取任务直到没有为止
-    for {
-      id, task := reserveJob()
-      if id == "" || task == nil || len(task.Payloads) == 0 {
-        break
-      }
-      // 获取所有的价格较上次更新有变动的商品ID
-      arr := collectChanged(task)
-      if len(arr) > 0 {
-        putMsgJob(arr)
-      }
-      e := conn.Delete(id)
-      if e != nil {
-        logger.Error().Err(e).Msg("ERR: Delete")
-      }
-    }
-    putRunnerJob()
-    scheduleNextTime()
+  defer close(runDone)
+  wg := &sync.WaitGroup{}
+  for i, q := range workerQueues {
+    wg.Add(1)
+    go func(name string, q Queue) {
+      defer wg.Done()
+      consume(name, q)
+    }(fmt.Sprintf("worker %d", i), q)
   }
+  wg.Add(3)
+  go func() {
+    defer wg.Done()
+    loop("dispatch product", productSchedule.next, dispatchProducts)
+  }()
+  go func() {
+    defer wg.Done()
+    loop("dispatch msg", msgInterval, dispatchMsgs)
+  }()
+  go func() {
+    defer wg.Done()
+    loop("check inflight", inflightInterval, func() {
+      checkInflight()
+      recoverPendingMsgs(false)
+      pruneFailures()
+    })
+  }()
+  wg.Wait()
 }
 
-func scheduleNextTime() {
-  logger.Info().Msg("schedule next time")
-  time.AfterFunc(time.Minute*time.Duration(Conf.Task.PollingInterval), func() {
-    loopChan <- struct{}{}
-  })
+// 没有配置msg_polling_interval时的消息分发间隔
+const defaultMsgPollingInterval = time.Second * 10
+
+func msgInterval(last time.Time) time.Time {
+  d := time.Second * time.Duration(Conf.Task.MsgPollingInterval)
+  if d <= 0 {
+    d = defaultMsgPollingInterval
+  }
+  return last.Add(d)
+}
+
+// 按next(上次执行时间)计算的时间执行f，第一次执行时上次执行时间为零值，
+// 每次等待结束后重新计算（规则可能已经变化，比如进入了暂停时间段），直到开始退出
+func loop(name string, next func(last time.Time) time.Time, f func()) {
+  var last time.Time
+  for !stopping() {
+    d := next(last).Sub(time.Now())
+    if d <= 0 {
+      tick(name, 0)
+      f()
+      last = time.Now()
+      continue
+    }
+    tick(name, d)
+    logger.Debug().Msgf("%s, next time in %s", name, d)
+    select {
+    case <-stopChan:
+      return
+    case <-time.After(d):
+    }
+  }
 }
 
 func dump(file string, data []byte) {
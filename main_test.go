@@ -0,0 +1,47 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "testing"
+
+  "github.com/kwf2030/commons/boltdb"
+  "github.com/rs/zerolog"
+)
+
+func TestMain(m *testing.M) {
+  lg := zerolog.Nop()
+  logger = &lg
+  os.Exit(m.Run())
+}
+
+// 使用内存存储，返回的memoryStore用于准备数据
+func newTestStore() *memoryStore {
+  s := newMemoryStore()
+  store = s
+  return s
+}
+
+// 使用临时文件的bolt，返回的函数用于关闭并删除
+func newTestKV(t *testing.T) func() {
+  f, e := ioutil.TempFile("", "dispatcher_test_*.db")
+  if e != nil {
+    t.Fatal(e)
+  }
+  f.Close()
+  kv, e = boltdb.Open(f.Name(), string(bucketVar), string(bucketFailure), string(bucketRateLimit), string(bucketOutbox), string(bucketInflight), string(bucketMsgOutbox))
+  if e != nil {
+    t.Fatal(e)
+  }
+  return func() {
+    kv.Close()
+    os.Remove(f.Name())
+  }
+}
+
+// 使用内存队列
+func newTestQueue() *memoryQueue {
+  q := newMemoryQueue()
+  queue = q
+  return q
+}
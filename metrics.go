@@ -0,0 +1,262 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "io"
+  "math"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+const metricsNamespace = "hiprice_dispatcher_"
+
+var (
+  metricsMu  = &sync.Mutex{}
+  allMetrics = make([]metric, 0, 16)
+
+  latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+  sizeBuckets    = []float64{1, 5, 10, 20, 50, 100, 200, 500, 1000}
+  taskBuckets    = []float64{60, 300, 600, 1800, 3600, 7200, 14400, 21600, 43200}
+)
+
+var (
+  metricJobsReserved      = newCounterVec("jobs_reserved_total", "Report jobs reserved from the reserve tube.")
+  metricJobsFailed        = newCounterVec("jobs_failed_total", "Report jobs that failed to process, by action (release/bury).", "action")
+  metricPayloadsProcessed = newCounterVec("payloads_processed_total", "Payloads in reserved report jobs.")
+  metricProductsChanged   = newCounterVec("products_changed_total", "Products whose price changed since the last update.")
+  metricNotifications     = newCounterVec("notifications_total", "Notifications produced, by user.", "user")
+  metricDispatchBatch     = newHistogramVec("dispatch_batch_size", "Payloads in each runner job put by putRunnerJob.", sizeBuckets)
+  metricDBLatency         = newHistogramVec("db_query_duration_seconds", "Store operation latency, by operation.", latencyBuckets, "op")
+  metricQueueErrors       = newCounterVec("queue_errors_total", "Queue operation errors, by operation.", "op")
+  metricLastReserve       = newGaugeVec("last_reserve_timestamp_seconds", "Unix time of the last reserved report job.")
+  metricConnUp            = newGaugeVec("connection_up", "Whether the connection is usable (1) or not (0), by target (database/queue).", "target")
+  metricTaskLatency       = newHistogramVec("task_round_trip_seconds", "Time from putting a runner job to reserving its report.", taskBuckets)
+  metricTasksInflight     = newGaugeVec("tasks_inflight", "Runner jobs put and not reported yet.")
+  metricTasksTimedOut     = newCounterVec("tasks_timed_out_total", "Runner jobs not reported within TTR and redispatched.")
+  metricProductsRetried   = newCounterVec("products_retried_total", "Products missing or failed in reports, by result (retry/dead).", "result")
+  metricNotifySuppressed  = newCounterVec("notifications_suppressed_total", "Notifications suppressed by the ledger, by reason (cooldown/not_new_low).", "reason")
+)
+
+type metric interface {
+  write(w io.Writer)
+}
+
+type labeled struct {
+  name   string
+  help   string
+  labels []string
+}
+
+func (m *labeled) key(values []string) string {
+  if len(values) != len(m.labels) {
+    panic(fmt.Sprintf("metric %s: expected %d label values, got %d", m.name, len(m.labels), len(values)))
+  }
+  return strings.Join(values, "\xff")
+}
+
+func (m *labeled) format(key string, extra ...string) string {
+  arr := make([]string, 0, len(m.labels)+1)
+  if len(m.labels) > 0 {
+    values := strings.Split(key, "\xff")
+    for i, l := range m.labels {
+      arr = append(arr, l+`="`+escapeLabel(values[i])+`"`)
+    }
+  }
+  arr = append(arr, extra...)
+  if len(arr) == 0 {
+    return ""
+  }
+  return "{" + strings.Join(arr, ",") + "}"
+}
+
+func (m *labeled) header(w io.Writer, typ string) {
+  fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsNamespace, m.name, m.help, metricsNamespace, m.name, typ)
+}
+
+type counterVec struct {
+  labeled
+  l      *sync.Mutex
+  values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+  c := &counterVec{
+    labeled: labeled{name: name, help: help, labels: labels},
+    l:       &sync.Mutex{},
+    values:  make(map[string]float64, 4),
+  }
+  if len(labels) == 0 {
+    c.values[""] = 0
+  }
+  register(c)
+  return c
+}
+
+func (c *counterVec) Add(v float64, labels ...string) {
+  k := c.key(labels)
+  c.l.Lock()
+  c.values[k] += v
+  c.l.Unlock()
+}
+
+func (c *counterVec) Inc(labels ...string) {
+  c.Add(1, labels...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+  c.header(w, "counter")
+  c.l.Lock()
+  defer c.l.Unlock()
+  for _, k := range sortedKeys(c.values) {
+    fmt.Fprintf(w, "%s%s%s %s\n", metricsNamespace, c.name, c.format(k), formatFloat(c.values[k]))
+  }
+}
+
+type gaugeVec struct {
+  counterVec
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+  g := &gaugeVec{counterVec{
+    labeled: labeled{name: name, help: help, labels: labels},
+    l:       &sync.Mutex{},
+    values:  make(map[string]float64, 4),
+  }}
+  if len(labels) == 0 {
+    g.values[""] = 0
+  }
+  register(g)
+  return g
+}
+
+func (g *gaugeVec) Set(v float64, labels ...string) {
+  k := g.key(labels)
+  g.l.Lock()
+  g.values[k] = v
+  g.l.Unlock()
+}
+
+func (g *gaugeVec) write(w io.Writer) {
+  g.header(w, "gauge")
+  g.l.Lock()
+  defer g.l.Unlock()
+  for _, k := range sortedKeys(g.values) {
+    fmt.Fprintf(w, "%s%s%s %s\n", metricsNamespace, g.name, g.format(k), formatFloat(g.values[k]))
+  }
+}
+
+type histogram struct {
+  counts []uint64
+  sum    float64
+  count  uint64
+}
+
+type histogramVec struct {
+  labeled
+  buckets []float64
+  l       *sync.Mutex
+  values  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+  h := &histogramVec{
+    labeled: labeled{name: name, help: help, labels: labels},
+    buckets: buckets,
+    l:       &sync.Mutex{},
+    values:  make(map[string]*histogram, 4),
+  }
+  register(h)
+  return h
+}
+
+func (h *histogramVec) Observe(v float64, labels ...string) {
+  k := h.key(labels)
+  h.l.Lock()
+  defer h.l.Unlock()
+  hg, ok := h.values[k]
+  if !ok {
+    hg = &histogram{counts: make([]uint64, len(h.buckets))}
+    h.values[k] = hg
+  }
+  for i, b := range h.buckets {
+    if v <= b {
+      hg.counts[i]++
+    }
+  }
+  hg.sum += v
+  hg.count++
+}
+
+func (h *histogramVec) Since(t time.Time, labels ...string) {
+  h.Observe(time.Since(t).Seconds(), labels...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+  h.header(w, "histogram")
+  h.l.Lock()
+  defer h.l.Unlock()
+  keys := make([]string, 0, len(h.values))
+  for k := range h.values {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+  for _, k := range keys {
+    hg := h.values[k]
+    for i, b := range h.buckets {
+      fmt.Fprintf(w, "%s%s_bucket%s %d\n", metricsNamespace, h.name, h.format(k, `le="`+formatFloat(b)+`"`), hg.counts[i])
+    }
+    fmt.Fprintf(w, "%s%s_bucket%s %d\n", metricsNamespace, h.name, h.format(k, `le="+Inf"`), hg.count)
+    fmt.Fprintf(w, "%s%s_sum%s %s\n", metricsNamespace, h.name, h.format(k), formatFloat(hg.sum))
+    fmt.Fprintf(w, "%s%s_count%s %d\n", metricsNamespace, h.name, h.format(k), hg.count)
+  }
+}
+
+func register(m metric) {
+  metricsMu.Lock()
+  allMetrics = append(allMetrics, m)
+  metricsMu.Unlock()
+}
+
+// Prometheus文本格式（version 0.0.4）
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+  buf := &bytes.Buffer{}
+  metricsMu.Lock()
+  for _, m := range allMetrics {
+    m.write(buf)
+  }
+  metricsMu.Unlock()
+  w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+  w.Write(buf.Bytes())
+}
+
+func sortedKeys(m map[string]float64) []string {
+  ret := make([]string, 0, len(m))
+  for k := range m {
+    ret = append(ret, k)
+  }
+  sort.Strings(ret)
+  return ret
+}
+
+func formatFloat(v float64) string {
+  switch {
+  case math.IsInf(v, 1):
+    return "+Inf"
+  case math.IsInf(v, -1):
+    return "-Inf"
+  case math.IsNaN(v):
+    return "NaN"
+  }
+  return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeLabel(v string) string {
+  v = strings.Replace(v, `\`, `\\`, -1)
+  v = strings.Replace(v, "\n", `\n`, -1)
+  return strings.Replace(v, `"`, `\"`, -1)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "errors"
+  "fmt"
+  "os"
+  "sort"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+  "github.com/rs/zerolog"
+)
+
+const migrateLockName = "hiprice_dispatcher_migrate"
+
+var errMigrateLocked = errors.New("migrate lock is held by another process")
+
+type migration struct {
+  Version int
+  Name    string
+  Up      []string
+  // 为空时不能回滚
+  Down []string
+}
+
+type migrationState struct {
+  Version     int
+  Name        string
+  Applied     bool
+  AppliedTime time.Time
+}
+
+// 执行所有未执行的migration，返回执行的数量
+func migrateUp(db *sql.DB) (int, error) {
+  n := 0
+  e := withMigrateLock(db, func(c *sql.Conn) error {
+    applied, e := appliedVersions(c)
+    if e != nil {
+      return e
+    }
+    for _, m := range sortedMigrations() {
+      if _, ok := applied[m.Version]; ok {
+        continue
+      }
+      // DDL在MySQL中会隐式提交，不能放在事务中回滚，
+      // 所以每条语句执行成功后才记录版本号
+      for _, stmt := range m.Up {
+        _, e := c.ExecContext(context.Background(), stmt)
+        if e != nil {
+          return fmt.Errorf("migrate up %d_%s: %s", m.Version, m.Name, e)
+        }
+      }
+      _, e := c.ExecContext(context.Background(), `INSERT INTO schema_migrations (version, name, applied_time) VALUES (?, ?, ?)`,
+        m.Version, m.Name, times.NowStr())
+      if e != nil {
+        return e
+      }
+      logger.Info().Msgf("migrate up, ok, version=%d, name=%s", m.Version, m.Name)
+      n++
+    }
+    return nil
+  })
+  return n, e
+}
+
+// 回滚最近执行的一个migration，返回回滚的版本号，没有可回滚的返回0
+func migrateDown(db *sql.DB) (int, error) {
+  v := 0
+  e := withMigrateLock(db, func(c *sql.Conn) error {
+    applied, e := appliedVersions(c)
+    if e != nil {
+      return e
+    }
+    arr := sortedMigrations()
+    for i := len(arr) - 1; i >= 0; i-- {
+      m := arr[i]
+      if _, ok := applied[m.Version]; !ok {
+        continue
+      }
+      if len(m.Down) == 0 {
+        return fmt.Errorf("migration %d_%s can not be rolled back", m.Version, m.Name)
+      }
+      for _, stmt := range m.Down {
+        _, e := c.ExecContext(context.Background(), stmt)
+        if e != nil {
+          return fmt.Errorf("migrate down %d_%s: %s", m.Version, m.Name, e)
+        }
+      }
+      _, e := c.ExecContext(context.Background(), `DELETE FROM schema_migrations WHERE version=?`, m.Version)
+      if e != nil {
+        return e
+      }
+      logger.Info().Msgf("migrate down, ok, version=%d, name=%s", m.Version, m.Name)
+      v = m.Version
+      break
+    }
+    return nil
+  })
+  return v, e
+}
+
+func migrateStatus(db *sql.DB) ([]*migrationState, error) {
+  var ret []*migrationState
+  e := withMigrateLock(db, func(c *sql.Conn) error {
+    applied, e := appliedVersions(c)
+    if e != nil {
+      return e
+    }
+    for _, m := range sortedMigrations() {
+      s := &migrationState{Version: m.Version, Name: m.Name}
+      if t, ok := applied[m.Version]; ok {
+        s.Applied = true
+        s.AppliedTime = t
+      }
+      ret = append(ret, s)
+    }
+    return nil
+  })
+  return ret, e
+}
+
+func sortedMigrations() []*migration {
+  arr := make([]*migration, len(migrations))
+  copy(arr, migrations)
+  sort.Slice(arr, func(i, j int) bool {
+    return arr[i].Version < arr[j].Version
+  })
+  return arr
+}
+
+func appliedVersions(c *sql.Conn) (map[int]time.Time, error) {
+  _, e := c.ExecContext(context.Background(), `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INT NOT NULL,
+    name VARCHAR(128) NOT NULL,
+    applied_time DATETIME NOT NULL,
+    PRIMARY KEY (version)
+  ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`)
+  if e != nil {
+    return nil, e
+  }
+  rows, e := c.QueryContext(context.Background(), `SELECT version, applied_time FROM schema_migrations`)
+  if e != nil {
+    return nil, e
+  }
+  defer rows.Close()
+  ret := make(map[int]time.Time, len(migrations))
+  for rows.Next() {
+    var v int
+    var t time.Time
+    e := rows.Scan(&v, &t)
+    if e != nil {
+      return nil, e
+    }
+    ret[v] = t
+  }
+  return ret, rows.Err()
+}
+
+// 多个dispatcher同时启动时，只有一个执行migration
+func withMigrateLock(db *sql.DB, f func(c *sql.Conn) error) error {
+  ctx := context.Background()
+  c, e := db.Conn(ctx)
+  if e != nil {
+    return e
+  }
+  defer c.Close()
+  var ok sql.NullInt64
+  e = c.QueryRowContext(ctx, `SELECT GET_LOCK(?, 60)`, migrateLockName).Scan(&ok)
+  if e != nil {
+    return e
+  }
+  if !ok.Valid || ok.Int64 != 1 {
+    return errMigrateLocked
+  }
+  defer c.ExecContext(ctx, `SELECT RELEASE_LOCK(?)`, migrateLockName)
+  return f(c)
+}
+
+// migrate子命令：dispatcher migrate [up|down|status] [conf.yaml]
+func runMigrate(args []string) {
+  action := "up"
+  file := "conf.yaml"
+  if len(args) > 0 {
+    action = args[0]
+  }
+  if len(args) > 1 {
+    file = args[1]
+  }
+  e := LoadConf(file)
+  if e != nil {
+    panic(e)
+  }
+  lg := zerolog.New(os.Stdout).With().Timestamp().Logger()
+  logger = &lg
+  initDB()
+  defer db.Close()
+
+  switch action {
+  case "up":
+    n, e := migrateUp(db)
+    if e != nil {
+      logger.Fatal().Err(e).Msg("ERR: migrate up")
+    }
+    fmt.Printf("%d migration(s) applied\n", n)
+
+  case "down":
+    v, e := migrateDown(db)
+    if e != nil {
+      logger.Fatal().Err(e).Msg("ERR: migrate down")
+    }
+    if v == 0 {
+      fmt.Println("no migration to roll back")
+    } else {
+      fmt.Printf("migration %d rolled back\n", v)
+    }
+
+  case "status":
+    arr, e := migrateStatus(db)
+    if e != nil {
+      logger.Fatal().Err(e).Msg("ERR: migrate status")
+    }
+    for _, s := range arr {
+      if s.Applied {
+        fmt.Printf("%4d  %-40s  applied at %s\n", s.Version, s.Name, s.AppliedTime.Format(times.DateTimeSFormat))
+      } else {
+        fmt.Printf("%4d  %-40s  pending\n", s.Version, s.Name)
+      }
+    }
+
+  default:
+    fmt.Println("usage: dispatcher migrate [up|down|status] [conf.yaml]")
+    os.Exit(2)
+  }
+}
@@ -0,0 +1,174 @@
+package main
+
+// 数据库结构变更，按Version升序执行，
+// 已发布的migration不要修改，结构变更要新增一个migration，
+// Down为空的migration不能回滚
+var migrations = []*migration{
+  {
+    Version: 1,
+    Name:    "create_tables",
+    Up: []string{
+      `CREATE TABLE IF NOT EXISTS msg (
+        _id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+        id VARCHAR(64) NOT NULL,
+        type INT NOT NULL DEFAULT 0,
+        content TEXT NOT NULL,
+        url VARCHAR(2048) NOT NULL DEFAULT '',
+        from_user_id VARCHAR(64) NOT NULL DEFAULT '',
+        create_time DATETIME NOT NULL,
+        PRIMARY KEY (_id),
+        UNIQUE KEY uk_msg_id (id)
+      ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
+
+      `CREATE TABLE IF NOT EXISTS product (
+        _id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+        id VARCHAR(64) NOT NULL,
+        source INT NOT NULL DEFAULT 0,
+        url VARCHAR(2048) NOT NULL DEFAULT '',
+        short_url VARCHAR(256) NOT NULL DEFAULT '',
+        title VARCHAR(512) NOT NULL DEFAULT '',
+        currency INT NOT NULL DEFAULT 0,
+        price DOUBLE NOT NULL DEFAULT -1,
+        price_low DOUBLE NOT NULL DEFAULT -1,
+        price_high DOUBLE NOT NULL DEFAULT -1,
+        stock INT NOT NULL DEFAULT -1,
+        sales INT NOT NULL DEFAULT -1,
+        category VARCHAR(256) NOT NULL DEFAULT '',
+        comments TEXT NOT NULL,
+        update_time DATETIME NOT NULL,
+        last_dispatch_time DATETIME NOT NULL,
+        PRIMARY KEY (_id),
+        UNIQUE KEY uk_product_id (id)
+      ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
+
+      `CREATE TABLE IF NOT EXISTS product_update (
+        _id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+        id VARCHAR(64) NOT NULL,
+        source INT NOT NULL DEFAULT 0,
+        url VARCHAR(2048) NOT NULL DEFAULT '',
+        short_url VARCHAR(256) NOT NULL DEFAULT '',
+        title VARCHAR(512) NOT NULL DEFAULT '',
+        currency INT NOT NULL DEFAULT 0,
+        price DOUBLE NOT NULL DEFAULT -1,
+        price_low DOUBLE NOT NULL DEFAULT -1,
+        price_high DOUBLE NOT NULL DEFAULT -1,
+        stock INT NOT NULL DEFAULT -1,
+        sales INT NOT NULL DEFAULT -1,
+        category VARCHAR(256) NOT NULL DEFAULT '',
+        comments TEXT NOT NULL,
+        update_time DATETIME NOT NULL,
+        PRIMARY KEY (_id),
+        KEY idx_product_update_id_time (id, update_time)
+      ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
+
+      `CREATE TABLE IF NOT EXISTS product_watch (
+        _id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+        user_id VARCHAR(64) NOT NULL,
+        product_id VARCHAR(64) NOT NULL,
+        currency INT NOT NULL DEFAULT 0,
+        price DOUBLE NOT NULL DEFAULT -1,
+        price_low DOUBLE NOT NULL DEFAULT -1,
+        price_high DOUBLE NOT NULL DEFAULT -1,
+        stock INT NOT NULL DEFAULT -1,
+        watch_time DATETIME NOT NULL,
+        unwatch_time DATETIME NULL,
+        state INT NOT NULL DEFAULT 0,
+        remind_decrease_option INT NOT NULL DEFAULT 0,
+        remind_decrease_value DOUBLE NOT NULL DEFAULT 0,
+        remind_increase_option INT NOT NULL DEFAULT 0,
+        remind_increase_value DOUBLE NOT NULL DEFAULT 0,
+        PRIMARY KEY (_id),
+        UNIQUE KEY uk_product_watch_user_product (user_id, product_id),
+        KEY idx_product_watch_product_state (product_id, state)
+      ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
+    },
+    // 已有的部署中这些表在migration之前就存在（Up不会新建），
+    // 回滚会删除线上数据，所以不能回滚
+    Down: nil,
+  },
+  {
+    Version: 2,
+    Name:    "add_product_next_dispatch_time",
+    Up: []string{
+      `ALTER TABLE product
+        ADD COLUMN next_dispatch_time DATETIME NULL,
+        ADD KEY idx_product_next_dispatch_time (next_dispatch_time)`,
+    },
+    Down: []string{
+      `ALTER TABLE product
+        DROP KEY idx_product_next_dispatch_time,
+        DROP COLUMN next_dispatch_time`,
+    },
+  },
+  {
+    Version: 3,
+    Name:    "add_product_rotation_index",
+    Up: []string{
+      `ALTER TABLE product ADD KEY idx_product_last_dispatch_time (last_dispatch_time, _id)`,
+    },
+    Down: []string{
+      `ALTER TABLE product DROP KEY idx_product_last_dispatch_time`,
+    },
+  },
+  {
+    Version: 4,
+    Name:    "add_product_fail_count",
+    Up: []string{
+      `ALTER TABLE product
+        ADD COLUMN fail_count INT NOT NULL DEFAULT 0,
+        ADD COLUMN dead TINYINT NOT NULL DEFAULT 0`,
+    },
+    Down: []string{
+      `ALTER TABLE product
+        DROP COLUMN dead,
+        DROP COLUMN fail_count`,
+    },
+  },
+  {
+    Version: 5,
+    Name:    "create_user_locale",
+    Up: []string{
+      `CREATE TABLE IF NOT EXISTS user_locale (
+        user_id VARCHAR(64) NOT NULL,
+        locale VARCHAR(16) NOT NULL,
+        update_time DATETIME NOT NULL,
+        PRIMARY KEY (user_id)
+      ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
+    },
+    Down: []string{
+      `DROP TABLE IF EXISTS user_locale`,
+    },
+  },
+  {
+    Version: 6,
+    Name:    "create_notify_ledger",
+    Up: []string{
+      `CREATE TABLE IF NOT EXISTS notify_ledger (
+        _id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+        user_id VARCHAR(64) NOT NULL,
+        product_id VARCHAR(64) NOT NULL,
+        event VARCHAR(16) NOT NULL,
+        currency INT NOT NULL DEFAULT 0,
+        price DOUBLE NOT NULL DEFAULT 0,
+        price_low DOUBLE NOT NULL DEFAULT 0,
+        price_high DOUBLE NOT NULL DEFAULT 0,
+        notify_time DATETIME NOT NULL,
+        PRIMARY KEY (_id),
+        KEY idx_notify_ledger_product_user (product_id, user_id, notify_time)
+      ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
+    },
+    Down: []string{
+      `DROP TABLE IF EXISTS notify_ledger`,
+    },
+  },
+  {
+    Version: 7,
+    Name:    "add_product_report_time",
+    Up: []string{
+      `ALTER TABLE product ADD COLUMN report_time DATETIME NULL`,
+    },
+    Down: []string{
+      `ALTER TABLE product DROP COLUMN report_time`,
+    },
+  },
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+  "testing"
+)
+
+func TestMigrations(t *testing.T) {
+  arr := sortedMigrations()
+  for i, m := range arr {
+    if m.Version != i+1 {
+      t.Fatalf("migration %s: version %d, want %d", m.Name, m.Version, i+1)
+    }
+    if len(m.Up) == 0 {
+      t.Errorf("migration %d_%s has no up statements", m.Version, m.Name)
+    }
+    // 只有第一个migration（已有的表）不能回滚
+    if (m.Version == 1) != (len(m.Down) == 0) {
+      t.Errorf("migration %d_%s: %d down statements", m.Version, m.Name, len(m.Down))
+    }
+  }
+}
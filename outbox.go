@@ -0,0 +1,275 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+
+  "github.com/kwf2030/commons/times"
+  "github.com/rs/xid"
+  "go.etcd.io/bbolt"
+)
+
+var bucketOutbox = []byte("outbox")
+
+// 待发布的抓取任务，保存在bolt的outbox bucket，key是任务ID，
+// 发布成功并且提交了消息游标和商品的分发时间后删除，
+// 启动时重新发布/提交还在outbox中的任务，保证至少分发一次
+type PendingTask struct {
+  Tube     string `json:"tube"`
+  Priority int    `json:"priority"`
+  Delay    int    `json:"delay,omitempty"`
+  Task     *Task  `json:"task"`
+  // 发布成功后需要保存的last_check_msg，0表示不需要
+  LastMsg uint64 `json:"last_msg,omitempty"`
+  // 已经发布成功，只需要提交
+  Published bool `json:"published,omitempty"`
+}
+
+// 先保存到outbox再发布，发布成功后提交，
+// 发布失败时从outbox删除，消息游标和分发时间都没有变化，下次检查时会重新分发，
+// 返回发布成功的任务ID，失败时返回空字符串
+func putRunnerJob(tube string, payloads []*Payload, priority int, lastMsg uint64) string {
+  return putRunnerJobDelay(tube, payloads, priority, Conf.Beanstalk.PutTubeDelay, lastMsg)
+}
+
+func putRunnerJobDelay(tube string, payloads []*Payload, priority, delay int, lastMsg uint64) string {
+  if len(payloads) == 0 {
+    logger.Debug().Msg("no data to dispatch")
+    if lastMsg > 0 {
+      saveLastCheckMsg(lastMsg)
+    }
+    return ""
+  }
+  tid := xid.New().String()
+  pt := &PendingTask{
+    Tube:     tube,
+    Priority: priority,
+    Delay:    delay,
+    Task: &Task{
+      ID:         tid,
+      CreateTime: times.Now(),
+      Payloads:   payloads,
+    },
+    LastMsg: lastMsg,
+  }
+  e := savePending(pt)
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: savePending")
+    return ""
+  }
+  e = publishPending(pt)
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: Publish")
+    removePending(tid)
+    return ""
+  }
+  metricDispatchBatch.Observe(float64(len(payloads)))
+  logger.Info().Msgf("put runner job, ok, dispatch %d items to %s, priority=%d, task id=%s", len(payloads), tube, priority, tid)
+  commitPending(pt)
+  return tid
+}
+
+func publishPending(pt *PendingTask) error {
+  data, _ := json.Marshal(pt.Task)
+  dump(fmt.Sprintf("%s/dump/%s_runner.json", Conf.Log.Dir, pt.Task.ID), data)
+  jobID, e := queue.Publish(pt.Tube, pt.Priority, pt.Delay, Conf.Beanstalk.PutTubeTTR, data)
+  if e != nil {
+    return e
+  }
+  pt.Published = true
+  trackInflight(pt, jobID)
+  e = savePending(pt)
+  if e != nil {
+    // 只影响重启后是否会重复发布
+    logger.Error().Err(e).Msg("ERR: savePending")
+  }
+  return nil
+}
+
+// 保存消息游标和商品的分发时间，成功后从outbox删除，
+// 失败时保留在outbox，下次启动时重新提交
+func commitPending(pt *PendingTask) {
+  products := make([]*Payload, 0, len(pt.Task.Payloads))
+  for _, v := range pt.Task.Payloads {
+    if v.Product != nil {
+      products = append(products, v)
+    }
+  }
+  e := saveDispatchTime(products, pt.Task.CreateTime)
+  if e != nil {
+    logger.Error().Err(e).Msgf("ERR: saveDispatchTime, task id=%s", pt.Task.ID)
+    return
+  }
+  if pt.LastMsg > lastCheckMsg {
+    saveLastCheckMsg(pt.LastMsg)
+  }
+  removePending(pt.Task.ID)
+}
+
+// 启动时处理上次退出前没有完成的任务，没有发布的重新发布，然后提交
+func recoverPending() {
+  arr := make([]*PendingTask, 0, 4)
+  invalid := make([]string, 0, 1)
+  e := kv.EachKV(bucketOutbox, func(k, v []byte, n int) error {
+    pt := &PendingTask{}
+    if e := json.Unmarshal(v, pt); e != nil || pt.Task == nil {
+      invalid = append(invalid, string(k))
+      return nil
+    }
+    arr = append(arr, pt)
+    return nil
+  })
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: EachKV")
+    return
+  }
+  for _, k := range invalid {
+    logger.Error().Msgf("invalid pending task %s, removed", k)
+    removePending(k)
+  }
+  for _, pt := range arr {
+    if !pt.Published {
+      e = publishPending(pt)
+      if e != nil {
+        // 保留在outbox，下次启动时再处理
+        logger.Error().Err(e).Msgf("ERR: Publish, task id=%s", pt.Task.ID)
+        continue
+      }
+    }
+    commitPending(pt)
+  }
+  logger.Info().Msgf("recover pending, ok, %d tasks", len(arr))
+}
+
+func savePending(pt *PendingTask) error {
+  data, e := json.Marshal(pt)
+  if e != nil {
+    return e
+  }
+  return kv.UpdateV(bucketOutbox, []byte(pt.Task.ID), data)
+}
+
+func removePending(tid string) {
+  e := kv.UpdateB(bucketOutbox, func(b *bbolt.Bucket) error {
+    return b.Delete([]byte(tid))
+  })
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: removePending")
+  }
+}
+
+var bucketMsgOutbox = []byte("msg_outbox")
+
+// 待发布的推送消息，保存在bolt的msg_outbox bucket，key是消息ID，
+// 发布成功并且记录了通知后删除，
+// 发布失败的在检查inflight任务时重新发布，启动时重新发布/提交所有还在msg_outbox中的消息
+type PendingMsg struct {
+  ID            string          `json:"id"`
+  Data          json.RawMessage `json:"data"`
+  Notifications []*Notification `json:"notifications"`
+  // 已经发布成功，只需要提交
+  Published bool `json:"published,omitempty"`
+  // 发布失败，等待重新发布
+  Retry bool `json:"retry,omitempty"`
+}
+
+// 先保存到msg_outbox再发布，发布成功后记录通知，
+// 发布失败时保留在msg_outbox（这时商品已经更新，report重试也不会再生成这些通知）
+func putPendingMsg(data []byte, arr []*Notification) error {
+  m := &PendingMsg{ID: xid.New().String(), Data: data, Notifications: arr}
+  e := savePendingMsg(m)
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: savePendingMsg")
+    return e
+  }
+  e = publishPendingMsg(m)
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: Publish")
+    m.Retry = true
+    if e := savePendingMsg(m); e != nil {
+      logger.Error().Err(e).Msg("ERR: savePendingMsg")
+    }
+    return e
+  }
+  commitPendingMsg(m)
+  return nil
+}
+
+func publishPendingMsg(m *PendingMsg) error {
+  _, e := queue.Publish(Conf.Beanstalk.PutTubeMsg, Conf.Beanstalk.PutTubePriority, Conf.Beanstalk.PutTubeDelay, Conf.Beanstalk.PutTubeTTR, m.Data)
+  if e != nil {
+    return e
+  }
+  m.Published = true
+  m.Retry = false
+  e = savePendingMsg(m)
+  if e != nil {
+    // 只影响重启后是否会重复发布
+    logger.Error().Err(e).Msg("ERR: savePendingMsg")
+  }
+  return nil
+}
+
+// 记录通知（用于去重），然后从msg_outbox删除
+func commitPendingMsg(m *PendingMsg) {
+  recordNotifications(m.Notifications, times.Now())
+  removePendingMsg(m.ID)
+}
+
+// all为false时只处理发布失败的消息（其他的可能正在被worker处理），
+// 为true时（启动时还没有worker）处理所有消息
+func recoverPendingMsgs(all bool) {
+  arr := make([]*PendingMsg, 0, 4)
+  invalid := make([]string, 0, 1)
+  e := kv.EachKV(bucketMsgOutbox, func(k, v []byte, n int) error {
+    m := &PendingMsg{}
+    if e := json.Unmarshal(v, m); e != nil || m.ID == "" {
+      invalid = append(invalid, string(k))
+      return nil
+    }
+    if all || m.Retry {
+      arr = append(arr, m)
+    }
+    return nil
+  })
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: EachKV")
+    return
+  }
+  for _, k := range invalid {
+    logger.Error().Msgf("invalid pending msg %s, removed", k)
+    removePendingMsg(k)
+  }
+  n := 0
+  for _, m := range arr {
+    if !m.Published {
+      e = publishPendingMsg(m)
+      if e != nil {
+        logger.Error().Err(e).Msgf("ERR: Publish, msg id=%s", m.ID)
+        continue
+      }
+    }
+    commitPendingMsg(m)
+    n++
+  }
+  if len(arr) > 0 {
+    logger.Info().Msgf("recover pending msgs, ok, %d/%d msgs", n, len(arr))
+  }
+}
+
+func savePendingMsg(m *PendingMsg) error {
+  data, e := json.Marshal(m)
+  if e != nil {
+    return e
+  }
+  return kv.UpdateV(bucketMsgOutbox, []byte(m.ID), data)
+}
+
+func removePendingMsg(id string) {
+  e := kv.UpdateB(bucketMsgOutbox, func(b *bbolt.Bucket) error {
+    return b.Delete([]byte(id))
+  })
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: removePendingMsg")
+  }
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+  "testing"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+)
+
+// 准备一个待分发的商品和一个outbox中的任务
+func pendingTestTask(t *testing.T, s *memoryStore, published bool) *PendingTask {
+  addDueProducts(s, 1, 1, "a.com", times.Now().Add(-time.Hour))
+  p := s.d.products["s1_a.com_0"].p
+  pt := &PendingTask{
+    Tube: "t1",
+    Task: &Task{
+      ID:         "task1",
+      CreateTime: times.Now().Truncate(time.Second),
+      Payloads:   []*Payload{{Product: runnerProduct(p)}},
+    },
+    LastMsg:   5,
+    Published: published,
+  }
+  if e := savePending(pt); e != nil {
+    t.Fatal(e)
+  }
+  return pt
+}
+
+func pendingCount() int {
+  n := 0
+  kv.EachKV(bucketOutbox, func(k, v []byte, i int) error {
+    n++
+    return nil
+  })
+  return n
+}
+
+// 检查任务已经提交：消息游标和商品的分发时间已经保存，并且从outbox删除
+func checkCommitted(t *testing.T, s *memoryStore, pt *PendingTask) {
+  if lastCheckMsg != pt.LastMsg {
+    t.Errorf("last_check_msg: %d", lastCheckMsg)
+  }
+  if dt := s.d.products["s1_a.com_0"].lastDispatchTime; !dt.Equal(pt.Task.CreateTime) {
+    t.Errorf("last_dispatch_time: %s", dt)
+  }
+  if n := pendingCount(); n != 0 {
+    t.Errorf("%d tasks left in outbox", n)
+  }
+}
+
+func TestRecoverPendingUnpublished(t *testing.T) {
+  defer newTestKV(t)()
+  defer setDispatchConf()()
+  lastCheckMsg = 0
+  s := newTestStore()
+  q := newTestQueue()
+  pt := pendingTestTask(t, s, false)
+
+  recoverPending()
+  if got := drainTube(t, q, "t1"); len(got) != 1 || got[0] != 1 {
+    t.Fatalf("published: %v", got)
+  }
+  checkCommitted(t, s, pt)
+}
+
+func TestRecoverPendingPublished(t *testing.T) {
+  defer newTestKV(t)()
+  defer setDispatchConf()()
+  lastCheckMsg = 0
+  s := newTestStore()
+  q := newTestQueue()
+  pt := pendingTestTask(t, s, true)
+
+  recoverPending()
+  if got := drainTube(t, q, "t1"); len(got) != 0 {
+    t.Fatalf("published again: %v", got)
+  }
+  checkCommitted(t, s, pt)
+}
+
+// 发布失败时消息游标和商品的分发时间都不变，下次检查时重新分发
+func TestPublishFailedNotCommitted(t *testing.T) {
+  defer newTestKV(t)()
+  defer setDispatchConf()()
+  lastCheckMsg = 0
+  s := newTestStore()
+  queue = &failQueue{newMemoryQueue()}
+  addDueProducts(s, 1, 1, "a.com", times.Now().Add(-time.Hour))
+  p := s.d.products["s1_a.com_0"].p
+  dt0 := s.d.products["s1_a.com_0"].lastDispatchTime
+
+  if tid := putRunnerJob("t1", []*Payload{{Product: runnerProduct(p)}}, 0, 5); tid != "" {
+    t.Fatalf("published: %s", tid)
+  }
+  if lastCheckMsg != 0 {
+    t.Errorf("last_check_msg: %d", lastCheckMsg)
+  }
+  if dt := s.d.products["s1_a.com_0"].lastDispatchTime; !dt.Equal(dt0) {
+    t.Errorf("last_dispatch_time: %s", dt)
+  }
+  if n := pendingCount(); n != 0 {
+    t.Errorf("%d tasks left in outbox", n)
+  }
+
+  // 启动时重新发布失败，保留在outbox，也不提交
+  s = newTestStore()
+  pendingTestTask(t, s, false)
+  dt0 = s.d.products["s1_a.com_0"].lastDispatchTime
+  recoverPending()
+  if lastCheckMsg != 0 {
+    t.Errorf("recover, last_check_msg: %d", lastCheckMsg)
+  }
+  if dt := s.d.products["s1_a.com_0"].lastDispatchTime; !dt.Equal(dt0) {
+    t.Errorf("recover, last_dispatch_time: %s", dt)
+  }
+  if n := pendingCount(); n != 1 {
+    t.Errorf("recover, %d tasks in outbox", n)
+  }
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+  "encoding/json"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+  "go.etcd.io/bbolt"
+)
+
+// report中没有返回或者没有抓取到价格的商品放回轮转，product_retry.delay秒后重新分发，
+// 连续失败max_failures次后标记为失效，不再分发（抓取成功时恢复），
+// it是任务发布时的记录，没有记录时只检查report中的商品，
+// 超时后才返回的report不处理（任务已经整体重新分发），
+// 同一个任务只处理一次（report重复投递时不会重复计数）
+func retryFailed(task *Task, it *InflightTask) {
+  if it != nil && it.State == InflightTimeout {
+    return
+  }
+  dispatched := make(map[string]*Product, 16)
+  if it != nil {
+    for _, v := range it.Payloads {
+      if v.Product != nil && v.Product.ID != "" {
+        dispatched[v.Product.ID] = v.Product
+      }
+    }
+  }
+  failed := make([]*Product, 0, 4)
+  reported := make(map[string]struct{}, len(task.Payloads))
+  for _, v := range task.Payloads {
+    p := v.Product
+    if p == nil || p.ID == "" {
+      continue
+    }
+    reported[p.ID] = struct{}{}
+    if p.Price == NoScript || p.Price == NoValue {
+      if d, ok := dispatched[p.ID]; ok {
+        p = d
+      }
+      failed = append(failed, p)
+    }
+  }
+  for id, p := range dispatched {
+    if _, ok := reported[id]; !ok {
+      failed = append(failed, p)
+    }
+  }
+  if len(failed) == 0 {
+    return
+  }
+  if task.ID != "" && !markRetried(task.ID) {
+    logger.Info().Msgf("failed products of task %s already retried", task.ID)
+    return
+  }
+
+  arr := make([]*Product, 0, len(failed))
+  for _, p := range failed {
+    n, dead, e := store.RecordProductFailure(p.ID, Conf.ProductRetry.MaxFailures)
+    if e != nil {
+      logger.Error().Err(e).Msgf("ERR: RecordProductFailure, product id=%s", p.ID)
+      continue
+    }
+    // 不在商品表中（比如分享的链接第一次就抓取失败）
+    if n == 0 {
+      continue
+    }
+    if dead {
+      metricProductsRetried.Inc("dead")
+      logger.Warn().Msgf("product %s failed %d times, marked as dead", p.ID, n)
+      continue
+    }
+    if p.AID == 0 {
+      continue
+    }
+    metricProductsRetried.Inc("retry")
+    arr = append(arr, p)
+  }
+  e := requeueProducts(arr, time.Second*time.Duration(Conf.ProductRetry.Delay))
+  if e != nil {
+    logger.Error().Err(e).Msgf("ERR: requeueProducts, task id=%s", task.ID)
+    return
+  }
+  if len(arr) > 0 {
+    logger.Info().Msgf("requeue %d failed products of task %s", len(arr), task.ID)
+  }
+}
+
+// 把商品放回轮转，delay后重新成为待分发状态，由dispatchProducts分发，
+// 和其他商品一样受来源的interval和令牌桶限制（不单独发布任务，避免同一个域名的商品集中重试），
+// 检查商品时要求last_dispatch_time早于当前时间-dispatch_duration（按商品计算分发时间时为min_interval），
+// 所以last_dispatch_time设置为当前时间+delay-dispatch_duration
+func requeueProducts(arr []*Product, delay time.Duration) error {
+  if len(arr) == 0 {
+    return nil
+  }
+  now := times.Now()
+  var d time.Duration
+  if Conf.Adaptive.Enabled {
+    d, _ = adaptiveIntervals()
+  } else if Conf.Task.DispatchDuration > 0 {
+    d = time.Minute * time.Duration(Conf.Task.DispatchDuration)
+  }
+  aids := make([]uint64, 0, len(arr))
+  for _, p := range arr {
+    aids = append(aids, p.AID)
+  }
+  return store.Tx(func(s Store) error {
+    e := s.SaveDispatchTime(aids, now.Add(delay-d))
+    if e != nil {
+      return e
+    }
+    if !Conf.Adaptive.Enabled {
+      return nil
+    }
+    for _, p := range arr {
+      e = s.SaveNextDispatchTime(p.ID, now.Add(delay))
+      if e != nil {
+        return e
+      }
+    }
+    return nil
+  })
+}
+
+// 在任务的inflight记录中标记已经重试，之前没有标记过时返回true，
+// 没有记录时（比如记录已经删除）新建一条，按保留时间删除，
+// 先标记再重试，重试前退出时这些商品等下一轮正常分发
+func markRetried(taskID string) bool {
+  first := false
+  e := kv.UpdateB(bucketInflight, func(b *bbolt.Bucket) error {
+    it := &InflightTask{}
+    if v := b.Get([]byte(taskID)); v != nil {
+      if e := json.Unmarshal(v, it); e != nil {
+        return e
+      }
+      if it.Retried {
+        return nil
+      }
+    } else {
+      now := times.Now()
+      it = &InflightTask{ID: taskID, State: InflightReported, CreateTime: now, ReportTime: now}
+    }
+    it.Retried = true
+    data, e := json.Marshal(it)
+    if e != nil {
+      return e
+    }
+    first = true
+    return b.Put([]byte(taskID), data)
+  })
+  if e != nil {
+    logger.Error().Err(e).Msgf("ERR: markRetried, task id=%s", taskID)
+    return false
+  }
+  return first
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+  "testing"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+)
+
+// report重复投递和超时后才返回的report都不能重复重试
+func TestRetryFailedOnce(t *testing.T) {
+  defer newTestKV(t)()
+  defer setDispatchConf()()
+  Conf.Task.DispatchDuration = 60
+  Conf.ProductRetry.Delay = 0
+  Conf.ProductRetry.MaxFailures = 10
+  s := newTestStore()
+  q := newTestQueue()
+  p := &Product{AID: 1, ID: "p1", URL: "https://a.com/1", Price: 1, UpdateTime: times.Now()}
+  s.RecordProductUpdate(p)
+
+  tid := putRunnerJob("t1", []*Payload{{Product: p}}, 0, 0)
+  drainTube(t, q, "t1")
+  for i := 0; i < 2; i++ {
+    retryFailed(reportTask(tid), reportInflight(tid))
+  }
+  if n := s.d.products["p1"].failCount; n != 1 {
+    t.Fatalf("fail count: %d", n)
+  }
+  dispatchProducts()
+  if got := drainTube(t, q, "task"); len(got) != 1 || got[0] != 1 {
+    t.Fatalf("retried: %v", got)
+  }
+
+  // 任务超时重新分发后，原来的report才返回
+  tid = putRunnerJob("t1", []*Payload{{Product: p}}, 0, 0)
+  drainTube(t, q, "t1")
+  expireInflight(t, tid)
+  checkInflight()
+  dispatchProducts()
+  drainTube(t, q, "task")
+  retryFailed(reportTask(tid), reportInflight(tid))
+  if n := s.d.products["p1"].failCount; n != 1 {
+    t.Fatalf("fail count after late report: %d", n)
+  }
+  dispatchProducts()
+  if got := drainTube(t, q, "task"); len(got) != 0 {
+    t.Fatalf("late report retried: %v", got)
+  }
+}
+
+// 重试的商品和其他商品一样受令牌桶限制，不会集中重新分发到同一个域名
+func TestRetryFailedRateLimited(t *testing.T) {
+  defer newTestKV(t)()
+  defer setDispatchConf(&SourceConf{Source: 1, Tube: "t1", Rate: 0.001, Burst: 2})()
+  Conf.Task.DispatchDuration = 60
+  Conf.ProductRetry.Delay = 0
+  Conf.ProductRetry.MaxFailures = 10
+  s := newTestStore()
+  q := newTestQueue()
+  addDueProducts(s, 1, 5, "a.com", times.Now().Add(-time.Hour*2))
+
+  // 直接发布，不消耗令牌
+  payloads := make([]*Payload, 0, 5)
+  reported := make([]*Payload, 0, 5)
+  for _, v := range s.d.products {
+    payloads = append(payloads, &Payload{Product: runnerProduct(v.p)})
+    reported = append(reported, &Payload{Product: &Product{AID: v.p.AID, ID: v.p.ID, Source: 1, Price: NoScript}})
+  }
+  tid := putRunnerJob("t1", payloads, 0, 0)
+  drainTube(t, q, "t1")
+  retryFailed(reportTask(tid, reported...), reportInflight(tid))
+  dispatchProducts()
+  if got := drainTube(t, q, "t1"); len(got) != 1 || got[0] != 2 {
+    t.Fatalf("retried: %v", got)
+  }
+}
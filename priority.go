@@ -0,0 +1,107 @@
+package main
+
+import (
+  "math"
+  "sort"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+)
+
+type scoredPayload struct {
+  payload *Payload
+  score   float64
+}
+
+// 按分数从高到低取前limit个商品，分数由以下几项加权相加：
+// watchers：log2(1+关注人数)，
+// threshold：当前价格离关注者设置的提醒阈值越近越高（0-1），
+// staleness：距离上次更新的时间，7天及以上为1（0-1），
+// fresh：fresh_hours内有新的分享（关注）时为1
+func rankProducts(payloads []*Payload, limit int) []*scoredPayload {
+  ids := make([]string, 0, len(payloads))
+  for _, v := range payloads {
+    ids = append(ids, v.Product.ID)
+  }
+  watches, e := store.WatchersOfProducts(ids)
+  if e != nil {
+    // 查不到关注信息时只按更新时间排序
+    logger.Error().Err(e).Msg("ERR: WatchersOfProducts")
+  }
+  now := times.Now()
+  w := Conf.Priority.Weights
+  fresh := now.Add(-time.Hour * time.Duration(Conf.Priority.FreshHours))
+  ret := make([]*scoredPayload, 0, len(payloads))
+  for _, v := range payloads {
+    p := v.Product
+    arr := watches[p.ID]
+    var th float64
+    isFresh := false
+    for _, pw := range arr {
+      th = math.Max(th, thresholdScore(p, pw))
+      if pw.WatchTime.After(fresh) {
+        isFresh = true
+      }
+    }
+    st := 1.0
+    if !p.UpdateTime.IsZero() {
+      st = math.Min(now.Sub(p.UpdateTime).Hours()/24/7, 1)
+    }
+    score := w.Watchers*math.Log2(float64(1+len(arr))) + w.Threshold*th + w.Staleness*st
+    if isFresh {
+      score += w.Fresh
+    }
+    ret = append(ret, &scoredPayload{
+      payload: &Payload{Product: runnerProduct(p)},
+      score:   score,
+    })
+  }
+  sort.SliceStable(ret, func(i, j int) bool {
+    return ret[i].score > ret[j].score
+  })
+  if len(ret) > limit {
+    ret = ret[:limit]
+  }
+  return ret
+}
+
+// 当前价格离提醒阈值的距离（占当前价格的比例）越小分数越高，
+// 已经达到阈值为1，没有设置提醒为0
+func thresholdScore(p *Product, pw *ProductWatch) float64 {
+  if p.Price <= 0 || pw.Price <= 0 {
+    return 0
+  }
+  d := math.Inf(1)
+  // 0：不提醒，1：按价格，2：按比例
+  switch pw.Rdo {
+  case 1:
+    d = math.Min(d, (p.Price-pw.Rdv)/p.Price)
+  case 2:
+    d = math.Min(d, pw.Rdv/100-(1-p.Price/pw.Price))
+  }
+  switch pw.Rio {
+  case 1:
+    d = math.Min(d, (pw.Riv-p.Price)/p.Price)
+  case 2:
+    d = math.Min(d, pw.Riv/100-(p.Price/pw.Price-1))
+  }
+  if math.IsInf(d, 1) {
+    return 0
+  }
+  return 1 - math.Max(math.Min(d, 1), 0)
+}
+
+// 新分享的链接还没有商品信息，按最高分计算（1个关注者，其他各项都取最大值）
+func msgScore() float64 {
+  w := Conf.Priority.Weights
+  return w.Watchers + w.Threshold + w.Staleness + w.Fresh
+}
+
+// 分数越高任务的优先级越高（beanstalk的priority越小越优先）
+func jobPriority(score float64) int {
+  ret := Conf.Beanstalk.PutTubePriority - int(score*float64(Conf.Priority.Scale))
+  if ret < 0 {
+    ret = 0
+  }
+  return ret
+}
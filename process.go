@@ -4,104 +4,129 @@ import (
   "encoding/json"
   "fmt"
   "math"
-  "time"
 
-  "github.com/kwf2030/commons/beanstalk"
   "github.com/kwf2030/commons/times"
 )
 
-func reserveJob() (string, *Task) {
-  id, job, e := conn.ReserveWithTimeout(Conf.Beanstalk.ReserveTimeout)
+// worker一直循环取任务，超时时间为0会导致空转
+func reserveTimeout() int {
+  if Conf.Beanstalk.ReserveTimeout <= 0 {
+    return 1
+  }
+  return Conf.Beanstalk.ReserveTimeout
+}
+
+// 取一个report任务，超时没有任务时job和error都为nil，
+// 队列错误时job为nil，任务内容无法解析时返回job和error（该任务需要bury）
+func reserveJob(q Queue) (*Job, *Task, error) {
+  job, e := q.Reserve(Conf.Beanstalk.ReserveTube, reserveTimeout())
   if e != nil {
-    if e != beanstalk.ErrTimedOut {
-      logger.Error().Err(e).Msg("ERR: ReserveWithTimeout")
+    if e == ErrReserveTimeout {
+      return nil, nil, nil
     }
-    return "", nil
+    logger.Error().Err(e).Msg("ERR: Reserve")
+    return nil, nil, e
   }
   t := &Task{}
-  e = json.Unmarshal(job, t)
+  e = json.Unmarshal(job.Body, t)
   if e != nil {
     logger.Error().Err(e).Msg("ERR: Unmarshal")
-    return "", nil
+    dump(fmt.Sprintf("%s/dump/job_%s_reserve.json", Conf.Log.Dir, job.ID), job.Body)
+    return job, nil, e
   }
-  dump(fmt.Sprintf("%s/dump/%s_reserve.json", Conf.Log.Dir, t.ID), job)
-  logger.Info().Msgf("reserve job, ok, job id=%s, %d items", id, len(t.Payloads))
-  return id, t
+  dump(fmt.Sprintf("%s/dump/%s_reserve.json", Conf.Log.Dir, t.ID), job.Body)
+  logger.Info().Msgf("reserve job, ok, job id=%s, %d items", job.ID, len(t.Payloads))
+  return job, t, nil
 }
 
-func collectChanged(t *Task) []string {
-  ret := make([]string, 0, len(t.Payloads))
-  tx, _ := db.Begin()
-  defer tx.Commit()
-  for _, payload := range t.Payloads {
-    msg := payload.Message
-    p := payload.Product
-    if p == nil || p.ID == "" || p.Price == NoScript || p.Price == NoValue {
-      continue
-    }
-    aid := 0
-    // 新增product_watch记录（不存在时）
-    // 更新product_watch的watch_time和state字段（存在且state为1时）
-    if msg != nil && msg.ID != "" {
-      var uid string
-      var ct time.Time
-      tx.QueryRow(`SELECT from_user_id, create_time FROM msg WHERE id=? LIMIT 1`, msg.ID).Scan(&uid, &ct)
-      if uid != "" {
-        wt := ct.Format(times.DateTimeSFormat)
-        var state int
-        tx.QueryRow(`SELECT _id, state FROM product_watch WHERE user_id=? AND product_id=? LIMIT 1`, uid, p.ID).Scan(&aid, &state)
-        if aid == 0 {
-          tx.Exec(`INSERT INTO product_watch (user_id, product_id, currency, price, price_low, price_high, stock, watch_time, state) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-            uid, p.ID, p.Currency, p.Price,
-            p.PriceLow, p.PriceHigh, p.Stock, wt, StateWatch)
-        } else if state == StateUnWatch {
-          tx.Exec(`UPDATE product_watch SET watch_time=?, state=? WHERE user_id=? AND product_id=?`, wt, StateWatch, uid, p.ID)
+// 每个report在一个事务中处理，任何语句失败都会回滚并返回error，
+// 由调用方决定是否重试
+func collectChanged(t *Task) ([]string, error) {
+  var ret []string
+  e := store.Tx(func(s Store) error {
+    ret = make([]string, 0, len(t.Payloads))
+    for _, payload := range t.Payloads {
+      msg := payload.Message
+      p := payload.Product
+      if p == nil || p.ID == "" || p.Price == NoScript || p.Price == NoValue {
+        continue
+      }
+      // 新增product_watch记录（不存在时）
+      // 更新product_watch的watch_time和state字段（存在且state为1时）
+      if msg != nil && msg.ID != "" {
+        uid, ct, e := s.MessageSender(msg.ID)
+        if e != nil {
+          return fmt.Errorf("query msg %s: %s", msg.ID, e)
+        }
+        if uid != "" {
+          e = s.UpsertWatch(uid, p, ct)
+          if e != nil {
+            return fmt.Errorf("upsert watch %s/%s: %s", uid, p.ID, e)
+          }
         }
       }
-    }
 
-    ut := p.UpdateTime.Format(times.DateTimeSFormat)
-    var price, priceLow, priceHigh float64 = NoValue, 0, 0
-    var stock int
-    tx.QueryRow(`SELECT price, price_low, price_high, stock FROM product_update WHERE id=? ORDER BY update_time DESC LIMIT 1`, p.ID).Scan(&price, &priceLow, &priceHigh, &stock)
-    if validateChanged(p, price, priceLow, priceHigh) {
-      // 记录价格有变动的productID，如果price是NoValue说明是新数据，不算价格变动
-      if price != NoValue {
-        ret = append(ret, p.ID)
+      var price, priceLow, priceHigh float64 = NoValue, 0, 0
+      last, e := s.LatestUpdate(p.ID)
+      if e != nil {
+        return fmt.Errorf("query product_update %s: %s", p.ID, e)
       }
-
-      // 新增price_update记录
-      var comments string
-      if p.Comments.Total > 0 {
-        data, _ := json.Marshal(p.Comments)
-        comments = string(data)
+      // 多个worker并发处理时，较早抓取的结果可能后处理，不能覆盖较新的结果，
+      // 价格没有变动时不会新增product_update记录，所以还要和最近处理的抓取时间比较
+      rt, e := s.ReportTime(p.ID)
+      if e != nil {
+        return fmt.Errorf("query report time %s: %s", p.ID, e)
       }
-      tx.Exec(`INSERT INTO product_update (id, source, url, short_url, title, currency, price, price_low, price_high, stock, sales, category, comments, update_time) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-        p.ID, p.Source, p.URL, p.ShortURL, p.Title,
-        p.Currency, p.Price, p.PriceLow, p.PriceHigh, p.Stock,
-        p.Sales, p.Category, comments, ut)
-
-      // 新增product记录（不存在时）
-      // 更新product记录（已存在时）
-      aid = 0
-      tx.QueryRow(`SELECT _id FROM product WHERE id=? LIMIT 1`, p.ID).Scan(&aid)
-      if aid == 0 {
-        // 新增记录时注意要加上last_dispatch_time字段
-        tx.Exec(`INSERT INTO product (id, source, url, short_url, title, currency, price, price_low, price_high, stock, sales, category, comments, update_time, last_dispatch_time) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-          p.ID, p.Source, p.URL, p.ShortURL, p.Title,
-          p.Currency, p.Price, p.PriceLow, p.PriceHigh, p.Stock,
-          p.Sales, p.Category, comments, ut, ut)
-      } else {
-        // 不需要更新last_dispatch_time字段，因为之前分发任务的时候已经更新过了
-        tx.Exec(`UPDATE product SET source=?, url=?, short_url=?, title=?, currency=?, price=?, price_low=?, price_high=?, stock=?, sales=?, category=?, comments=?, update_time=? WHERE id=?`,
-          p.Source, p.URL, p.ShortURL, p.Title, p.Currency,
-          p.Price, p.PriceLow, p.PriceHigh, p.Stock, p.Sales,
-          p.Category, comments, ut, p.ID)
+      if last != nil && last.UpdateTime.After(rt) {
+        rt = last.UpdateTime
+      }
+      if !p.UpdateTime.IsZero() && p.UpdateTime.Before(rt) {
+        logger.Warn().Msgf("skip stale product %s, update time %s is before %s", p.ID, p.UpdateTime.Format(times.DateTimeSFormat), rt.Format(times.DateTimeSFormat))
+        continue
+      }
+      if last != nil {
+        price, priceLow, priceHigh = last.Price, last.PriceLow, last.PriceHigh
+      }
+      e = s.ClearProductFailure(p.ID)
+      if e != nil {
+        return fmt.Errorf("clear failure %s: %s", p.ID, e)
+      }
+      if validateChanged(p, price, priceLow, priceHigh) {
+        // 新增price_update记录，新增或更新product记录
+        e = s.RecordProductUpdate(p)
+        if e != nil {
+          return fmt.Errorf("record product %s: %s", p.ID, e)
+        }
+        // 记录价格有变动的productID，如果price是NoValue说明是新数据，不算价格变动
+        if price != NoValue {
+          ret = append(ret, p.ID)
+        }
+      }
+      if !p.UpdateTime.IsZero() {
+        e = s.SaveReportTime(p.ID, p.UpdateTime)
+        if e != nil {
+          return fmt.Errorf("save report time %s: %s", p.ID, e)
+        }
+      }
+      if Conf.Adaptive.Enabled {
+        next, e := nextDispatchTime(s, p.ID, times.Now())
+        if e != nil {
+          return fmt.Errorf("compute next dispatch time %s: %s", p.ID, e)
+        }
+        e = s.SaveNextDispatchTime(p.ID, next)
+        if e != nil {
+          return fmt.Errorf("save next dispatch time %s: %s", p.ID, e)
+        }
       }
     }
+    return nil
+  })
+  if e != nil {
+    logger.Error().Err(e).Msgf("collect changed, rollback, task id=%s", t.ID)
+    return nil, e
   }
   logger.Info().Msgf("collect changed, ok, %d items changed", len(ret))
-  return ret
+  return ret, nil
 }
 
 // price/price_low/price_high任一字段变动
@@ -122,66 +147,69 @@ func validateChanged(p *Product, price, priceLow, priceHigh float64) bool {
   return false
 }
 
-func putMsgJob(products []string) {
-  m := createPushMsg(products)
-  if len(m) <= 0 {
+// 发布失败时返回error，消息保留在msg_outbox中稍后重新发布
+func putMsgJob(products []string) error {
+  pm := createPushMsg(products)
+  if len(pm.Notifications) <= 0 {
     logger.Info().Msg("no msg to push")
-    return
+    return nil
   }
-  e := conn.Use(Conf.Beanstalk.PutTubeMsg)
-  if e != nil {
-    logger.Error().Err(e).Msg("ERR: Use")
-    return
-  }
-  // 推送消息分两种，
+  // 推送消息分两种（由notify.groupings选择），
   // 一种是by_user：用户-->消息列表，按用户推送消息，
   // 一种是by_text：消息-->用户列表，按消息推送用户，
-  // {"by_user": [{"user1": ["text1", "text2"]}, {"user2": ["text3", "text4"]}], "by_text": [{"text1": ["user1", "user2"]}, {"text2": ["user3", "user4"]}]}
+  // {"by_user": {"user1": ["text1", "text2"], "user2": ["text3", "text4"]}, "by_text": {"text1": ["user1", "user2"], "text2": ["user3", "user4"]}}，
+  // version为2时还有notifications（结构化的通知列表，见Notification）
   ct := times.NowStrFormat(times.DateTimeFormat3)
-  data, _ := json.Marshal(map[string]interface{}{"by_user": m, "create_time": ct})
+  data, _ := json.Marshal(pushPayload(pm, ct))
   dump(fmt.Sprintf("%s/dump/%s_msg.json", Conf.Log.Dir, ct), data)
-  _, e = conn.Put(Conf.Beanstalk.PutTubePriority, Conf.Beanstalk.PutTubeDelay, Conf.Beanstalk.PutTubeTTR, data)
+  e := putPendingMsg(data, pm.Notifications)
   if e != nil {
-    logger.Error().Err(e).Msg("ERR: Put")
-    return
+    return e
   }
   logger.Info().Msg("put msg job, ok")
+  return nil
 }
 
-func createPushMsg(products []string) map[string][]string {
-  ret := make(map[string][]string, len(products)*10)
-  tx, _ := db.Begin()
-  defer tx.Rollback()
+func createPushMsg(products []string) *PushMsg {
+  ret := make([]*Notification, 0, len(products)*10)
+  now := times.Now()
+  seen := make(map[string]struct{}, len(products))
   for _, v := range products {
     if v == "" {
       continue
     }
-    p := NewProduct()
-    var comments string
-    r := tx.QueryRow(`SELECT _id, id, source, url, short_url, title, currency, price, price_low, price_high, stock, sales, category, comments, update_time FROM product WHERE id=? LIMIT 1`, v)
-    e := r.Scan(&p.AID, &p.ID, &p.Source, &p.URL, &p.ShortURL,
-      &p.Title, &p.Currency, &p.Price, &p.PriceLow, &p.PriceHigh,
-      &p.Stock, &p.Sales, &p.Category, &comments, &p.UpdateTime)
+    if _, ok := seen[v]; ok {
+      continue
+    }
+    seen[v] = struct{}{}
+    p, e := store.GetProduct(v)
     if e != nil {
-      logger.Error().Err(e).Msg("ERR: Scan")
+      logger.Error().Err(e).Msg("ERR: GetProduct")
       continue
     }
-    if p.ID == "" || p.Price == NoScript || p.Price == NoValue {
+    if p == nil || p.ID == "" || p.Price == NoScript || p.Price == NoValue {
       continue
     }
-    rows, e := tx.Query(`SELECT user_id, currency, price, price_low, price_high, stock, watch_time, remind_decrease_option, remind_decrease_value, remind_increase_option, remind_increase_value FROM product_watch WHERE product_id=? AND state=?`, v, StateWatch)
+    arr, e := store.WatchersOf(v)
     if e != nil {
-      logger.Error().Err(e).Msg("ERR: Query")
+      logger.Error().Err(e).Msg("ERR: WatchersOf")
       continue
     }
-    for rows.Next() {
-      pw := &ProductWatch{ProductID: v}
-      e := rows.Scan(&pw.UserID, &pw.Currency, &pw.Price, &pw.PriceLow, &pw.PriceHigh,
-        &pw.Stock, &pw.WatchTime, &pw.Rdo, &pw.Rdv, &pw.Rio, &pw.Riv)
-      if e != nil {
-        logger.Error().Err(e).Msg("ERR: Scan")
-        continue
-      }
+    uids := make([]string, 0, len(arr))
+    for _, pw := range arr {
+      uids = append(uids, pw.UserID)
+    }
+    // 查询失败时使用默认语言
+    ul, e := store.UserLocales(uids)
+    if e != nil {
+      logger.Error().Err(e).Msg("ERR: UserLocales")
+    }
+    // 查询失败时不去重
+    states, e := store.NotifyStates(v)
+    if e != nil {
+      logger.Error().Err(e).Msg("ERR: NotifyStates")
+    }
+    for _, pw := range arr {
       if pw.UserID == "" || pw.Price == NoScript || pw.Price == NoValue {
         continue
       }
@@ -189,80 +217,93 @@ func createPushMsg(products []string) map[string][]string {
       if pw.Rdo == 0 && pw.Rio == 0 {
         continue
       }
-      msg := concatMsg(p, pw)
-      if msg == "" {
+      n := concatMsg(p, pw, ul[pw.UserID])
+      if n == nil {
         continue
       }
-      if _, ok := ret[pw.UserID]; !ok {
-        ret[pw.UserID] = make([]string, 0, 2)
+      if reason := suppressNotification(n, states[pw.UserID], now); reason != "" {
+        metricNotifySuppressed.Inc(reason)
+        logger.Debug().Msgf("suppress %s notification of %s to %s, %s", n.Event, p.ID, pw.UserID, reason)
+        continue
       }
-      ret[pw.UserID] = append(ret[pw.UserID], msg)
+      ret = append(ret, n)
+      metricNotifications.Inc(pw.UserID)
     }
   }
-  return ret
+  return newPushMsg(ret)
 }
 
-func concatMsg(p *Product, pw *ProductWatch) string {
+// 判断是否需要提醒，需要时按事件类型的模板生成通知，不需要时返回nil
+func concatMsg(p *Product, pw *ProductWatch, locale string) *Notification {
+  data := &MsgData{
+    Locale:  normalizeLocale(locale),
+    Product: p,
+    Watch:   pw,
+    Title:   truncate(30, p.Title),
+    URL:     p.ShortURL,
+  }
   p1 := p.Price
   p2 := pw.Price
   if p1 >= 0 && p2 >= 0 {
+    data.Price = formatPrice(data.Locale, p.Currency, p1)
+    data.WatchPrice = formatPrice(data.Locale, pw.Currency, p2)
+    data.Delta = p1 - p2
     switch {
     case p1 == p2:
-      return ""
+      return nil
 
     case p1 < p2:
       // 降价
       if pw.Rdo == 0 {
-        return ""
+        return nil
       }
       rg := (1 - p1/p2) * 100
       logger.Debug().Msgf("%s[%.2f, %.2f], %.2f%%", p.ID, p2, p1, rg)
       if pw.Rdo == 1 {
         if pw.Rdv < p.Price {
-          return ""
+          return nil
         }
       } else if pw.Rdo == 2 {
         if pw.Rdv > rg {
-          return ""
+          return nil
         }
       }
-      r := []rune(p.Title)
-      if len(r) > 30 {
-        r = r[:30]
-        p.Title = string(r) + "..."
-      }
-      return fmt.Sprintf("%s 降价了，关注价%s 现价%s 降幅%d%% %s", p.Title, fmt.Sprintf(getCurrencyFormat(pw.Currency), p2), fmt.Sprintf(getCurrencyFormat(p.Currency), p1), int(math.Round(rg)), p.ShortURL)
+      data.Event = EventDecrease
+      data.Percent = int(math.Round(rg))
+      return newNotification(data)
 
     case p1 > p2:
       // 涨价
       if pw.Rio == 0 {
-        return ""
+        return nil
       }
       rg := (p1/p2 - 1) * 100
       logger.Debug().Msgf("%s[%.2f, %.2f], %.2f%%", p.ID, p2, p1, rg)
       if pw.Rio == 1 {
         if pw.Riv > p.Price {
-          return ""
+          return nil
         }
       } else if pw.Rio == 2 {
         if pw.Riv > rg {
-          return ""
+          return nil
         }
       }
-      r := []rune(p.Title)
-      if len(r) > 30 {
-        r = r[:30]
-        p.Title = string(r) + "..."
-      }
-      return fmt.Sprintf("%s 涨价了，关注价%s 现价%s 涨幅%d%% %s", p.Title, fmt.Sprintf(getCurrencyFormat(pw.Currency), p2), fmt.Sprintf(getCurrencyFormat(p.Currency), p1), int(math.Round(rg)), p.ShortURL)
+      data.Event = EventIncrease
+      data.Percent = int(math.Round(rg))
+      return newNotification(data)
     }
   }
   if p1 == RangePrice && p2 == RangePrice {
     if math.Abs(p.PriceLow-pw.PriceLow) >= 1 || math.Abs(p.PriceHigh-pw.PriceHigh) >= 1 {
-      return fmt.Sprintf("%s 价格有变动，关注价[%s-%s] 现价[%s-%s] %s", p.Title, fmt.Sprintf(getCurrencyFormat(pw.Currency), pw.PriceLow), fmt.Sprintf(getCurrencyFormat(pw.Currency), pw.PriceHigh), fmt.Sprintf(getCurrencyFormat(p.Currency), p.PriceLow), fmt.Sprintf(getCurrencyFormat(p.Currency), p.PriceHigh), p.ShortURL)
+      data.Event = EventRange
+      data.PriceLow = formatPrice(data.Locale, p.Currency, p.PriceLow)
+      data.PriceHigh = formatPrice(data.Locale, p.Currency, p.PriceHigh)
+      data.WatchPriceLow = formatPrice(data.Locale, pw.Currency, pw.PriceLow)
+      data.WatchPriceHigh = formatPrice(data.Locale, pw.Currency, pw.PriceHigh)
+      return newNotification(data)
     }
   }
-  return ""
+  return nil
 }
 
 func getCurrencyFormat(currency int) string {
@@ -0,0 +1,148 @@
+package main
+
+import (
+  "reflect"
+  "sort"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+)
+
+func reportTask(id string, payloads ...*Payload) *Task {
+  return &Task{ID: id, Payloads: payloads}
+}
+
+func reportProduct(id string, price float64, t time.Time) *Product {
+  return &Product{ID: id, URL: "https://item/" + id, ShortURL: "u/" + id, Title: "商品" + id, Price: price, UpdateTime: t}
+}
+
+func TestCollectChanged(t *testing.T) {
+  s := newTestStore()
+  t0 := times.Now().Add(-time.Hour)
+  s.addMessage(MsgLink, &Message{ID: "m1", URL: "https://item/p1"}, "u1", t0)
+
+  // 第一次抓取，新增商品和关注记录，不算价格变动
+  arr, e := collectChanged(reportTask("t1", &Payload{Message: &Message{ID: "m1"}, Product: reportProduct("p1", 100, t0)}))
+  if e != nil || len(arr) != 0 {
+    t.Fatalf("first report: %v, %v", arr, e)
+  }
+  watchers, _ := s.WatchersOf("p1")
+  if len(watchers) != 1 || watchers[0].UserID != "u1" || watchers[0].Price != 100 {
+    t.Fatalf("watchers: %+v", watchers)
+  }
+
+  cases := []struct {
+    price float64
+    want  []string
+  }{
+    {100, []string{}},
+    {80, []string{"p1"}},
+    {80, []string{}},
+    {NoValue, []string{}},
+    {90, []string{"p1"}},
+  }
+  for i, c := range cases {
+    p := reportProduct("p1", c.price, t0.Add(time.Minute*time.Duration(i+1)))
+    arr, e := collectChanged(reportTask("t", &Payload{Product: p}))
+    if e != nil {
+      t.Fatal(e)
+    }
+    if !reflect.DeepEqual(arr, c.want) {
+      t.Errorf("case %d price %v: got %v, want %v", i, c.price, arr, c.want)
+    }
+  }
+  p, _ := s.GetProduct("p1")
+  if p == nil || p.Price != 90 {
+    t.Fatalf("product: %+v", p)
+  }
+}
+
+func TestCreatePushMsg(t *testing.T) {
+  s := newTestStore()
+  Conf.Notify.TemplateDir = ""
+  Conf.Notify.DefaultLocale = LocaleZhCN
+  wt := times.Now().Add(-time.Hour)
+  s.RecordProductUpdate(reportProduct("p1", 80, wt))
+  s.RecordProductUpdate(reportProduct("p2", NoScript, wt))
+  // 按比例降价10%提醒
+  s.addWatch(&ProductWatch{UserID: "u1", ProductID: "p1", Price: 100, WatchTime: wt, Rdo: 2, Rdv: 10})
+  s.addWatch(&ProductWatch{UserID: "u2", ProductID: "p1", Price: 100, WatchTime: wt, Rdo: 2, Rdv: 10})
+  s.addWatch(&ProductWatch{UserID: "u3", ProductID: "p1", Price: 100, WatchTime: wt, Rdo: 2, Rdv: 10})
+  // 降到50以下才提醒
+  s.addWatch(&ProductWatch{UserID: "u4", ProductID: "p1", Price: 100, WatchTime: wt, Rdo: 1, Rdv: 50})
+  // 取消关注
+  s.addWatch(&ProductWatch{UserID: "u5", ProductID: "p1", Price: 100, WatchTime: wt, State: StateUnWatch, Rdo: 2, Rdv: 10})
+  // 不提醒
+  s.addWatch(&ProductWatch{UserID: "u6", ProductID: "p1", Price: 100, WatchTime: wt})
+  s.addWatch(&ProductWatch{UserID: "u1", ProductID: "p2", Price: 100, WatchTime: wt, Rdo: 2, Rdv: 10})
+  s.setUserLocale("u3", "en-US")
+
+  pm := createPushMsg([]string{"p1", "p2", "p1", ""})
+  users := make([]string, 0, len(pm.Notifications))
+  for _, n := range pm.Notifications {
+    users = append(users, n.UserID)
+    if n.Event != EventDecrease || n.ProductID != "p1" || n.Percent != 20 || n.WatchPrice != 100 || n.Price != 80 {
+      t.Errorf("notification: %+v", n)
+    }
+  }
+  sort.Strings(users)
+  if !reflect.DeepEqual(users, []string{"u1", "u2", "u3"}) {
+    t.Fatalf("users: %v", users)
+  }
+  zh := "商品p1 降价了，关注价￥100.00 现价￥80.00 降幅20% u/p1"
+  en := "商品p1 dropped in price: watched at CN¥100.00, now CN¥80.00 (-20%) u/p1"
+  if !reflect.DeepEqual(pm.ByUser["u1"], []string{zh}) || !reflect.DeepEqual(pm.ByUser["u3"], []string{en}) {
+    t.Errorf("by_user: %v", pm.ByUser)
+  }
+  sort.Strings(pm.ByText[zh])
+  if !reflect.DeepEqual(pm.ByText[zh], []string{"u1", "u2"}) || !reflect.DeepEqual(pm.ByText[en], []string{"u3"}) {
+    t.Errorf("by_text: %v", pm.ByText)
+  }
+}
+
+// 较早的抓取结果后处理时不能覆盖较新的结果，即使较新的结果价格没有变动
+func TestCollectChangedOutOfOrder(t *testing.T) {
+  s := newTestStore()
+  t0 := times.Now().Add(-time.Hour * 3)
+  for i, c := range []struct {
+    price float64
+    at    time.Time
+    want  []string
+  }{
+    {100, t0, []string{}},
+    {100, t0.Add(time.Hour * 2), []string{}},
+    {80, t0.Add(time.Hour), []string{}},
+    {80, t0.Add(time.Hour * 3), []string{"p1"}},
+  } {
+    arr, e := collectChanged(reportTask("t", &Payload{Product: reportProduct("p1", c.price, c.at)}))
+    if e != nil {
+      t.Fatal(e)
+    }
+    if !reflect.DeepEqual(arr, c.want) {
+      t.Errorf("report %d: got %v, want %v", i, arr, c.want)
+    }
+    if i == 2 {
+      p, _ := s.GetProduct("p1")
+      if p.Price != 100 {
+        t.Fatalf("stale report applied, price %v", p.Price)
+      }
+    }
+  }
+}
+
+// 关注价按关注时的币种，现价按商品现在的币种
+func TestNotificationCurrency(t *testing.T) {
+  Conf.Notify.TemplateDir = ""
+  p := reportProduct("p1", 80, times.Now())
+  p.Currency = 2
+  pw := &ProductWatch{UserID: "u1", ProductID: "p1", Price: 100, Rdo: 2, Rdv: 10}
+  n := concatMsg(p, pw, "en")
+  if n == nil || n.Currency != 2 || n.WatchCurrency != 0 {
+    t.Fatalf("notification: %+v", n)
+  }
+  want := "商品p1 dropped in price: watched at CN¥100.00, now $80.00 (-20%) u/p1"
+  if n.Text != want {
+    t.Errorf("text: got %q, want %q", n.Text, want)
+  }
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+  "time"
+)
+
+// 推送消息的版本，
+// 1：只有by_user（用户-->消息文本列表），
+// 2：增加notifications（结构化的通知列表），by_user保持不变，
+// 发送端可以按version判断是否使用notifications
+const pushVersion = 2
+
+// 结构化的通知，Text是渲染后的消息文本（和by_user中的相同）
+type Notification struct {
+  // decrease（降价）、increase（涨价）或range（区间价格变动）
+  Event     string `json:"event"`
+  UserID    string `json:"user_id"`
+  Locale    string `json:"locale"`
+  ProductID string `json:"product_id"`
+  Title     string `json:"title"`
+  // 现价的币种和关注价的币种（关注后商品可能换了币种）
+  Currency      int `json:"currency"`
+  WatchCurrency int `json:"watch_currency"`
+  // 关注价（旧价格）和现价（新价格），decrease和increase时有值
+  WatchPrice float64 `json:"watch_price,omitempty"`
+  Price      float64 `json:"price,omitempty"`
+  // 区间价格，range时有值
+  WatchPriceLow  float64 `json:"watch_price_low,omitempty"`
+  WatchPriceHigh float64 `json:"watch_price_high,omitempty"`
+  PriceLow       float64 `json:"price_low,omitempty"`
+  PriceHigh      float64 `json:"price_high,omitempty"`
+  // 涨幅或降幅的百分比，始终为正数
+  Percent   int       `json:"percent,omitempty"`
+  URL       string    `json:"url"`
+  WatchTime time.Time `json:"watch_time"`
+  Text      string    `json:"text"`
+}
+
+// 渲染消息文本并生成通知，渲染失败时返回nil（不发送）
+func newNotification(data *MsgData) *Notification {
+  text := renderMsg(data)
+  if text == "" {
+    return nil
+  }
+  p, pw := data.Product, data.Watch
+  n := &Notification{
+    Event:         data.Event,
+    UserID:        pw.UserID,
+    Locale:        data.Locale,
+    ProductID:     p.ID,
+    Title:         p.Title,
+    Currency:      p.Currency,
+    WatchCurrency: pw.Currency,
+    Percent:       data.Percent,
+    URL:           data.URL,
+    WatchTime:     pw.WatchTime,
+    Text:          text,
+  }
+  if data.Event == EventRange {
+    n.WatchPriceLow = pw.PriceLow
+    n.WatchPriceHigh = pw.PriceHigh
+    n.PriceLow = p.PriceLow
+    n.PriceHigh = p.PriceHigh
+  } else {
+    n.WatchPrice = pw.Price
+    n.Price = p.Price
+  }
+  return n
+}
+
+const (
+  GroupingByUser = "by_user"
+  GroupingByText = "by_text"
+)
+
+// 一批通知和它们的两种分组，
+// ByUser：用户-->消息列表，按用户推送消息，
+// ByText：消息-->用户列表，按消息推送用户（相同的消息只出现一次，用户不重复）
+type PushMsg struct {
+  Notifications []*Notification
+  ByUser        map[string][]string
+  ByText        map[string][]string
+}
+
+func newPushMsg(arr []*Notification) *PushMsg {
+  ret := &PushMsg{
+    Notifications: arr,
+    ByUser:        make(map[string][]string, len(arr)),
+    ByText:        make(map[string][]string, len(arr)),
+  }
+  seen := make(map[string]map[string]struct{}, len(arr))
+  for _, n := range arr {
+    ret.ByUser[n.UserID] = append(ret.ByUser[n.UserID], n.Text)
+    if _, ok := seen[n.Text]; !ok {
+      seen[n.Text] = make(map[string]struct{}, 2)
+    }
+    if _, ok := seen[n.Text][n.UserID]; ok {
+      continue
+    }
+    seen[n.Text][n.UserID] = struct{}{}
+    ret.ByText[n.Text] = append(ret.ByText[n.Text], n.UserID)
+  }
+  return ret
+}
+
+// 生成put_tube_msg的消息，包含notify.groupings配置的分组（没有配置时只有by_user），
+// push_version为1时没有version和notifications
+func pushPayload(pm *PushMsg, createTime string) map[string]interface{} {
+  ret := map[string]interface{}{"create_time": createTime}
+  groupings := Conf.Notify.Groupings
+  if len(groupings) == 0 {
+    groupings = []string{GroupingByUser}
+  }
+  for _, v := range groupings {
+    switch v {
+    case GroupingByUser:
+      ret[GroupingByUser] = pm.ByUser
+    case GroupingByText:
+      ret[GroupingByText] = pm.ByText
+    default:
+      logger.Warn().Msgf("unknown notify grouping %s", v)
+    }
+  }
+  if Conf.Notify.PushVersion == 1 {
+    return ret
+  }
+  ret["version"] = pushVersion
+  ret["notifications"] = pm.Notifications
+  return ret
+}
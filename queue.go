@@ -0,0 +1,85 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "strings"
+)
+
+var (
+  ErrReserveTimeout = errors.New("reserve timed out")
+  ErrJobNotFound    = errors.New("job not found")
+)
+
+// 任务的状态（JobState的返回值）
+const (
+  JobReady    = "ready"
+  JobDelayed  = "delayed"
+  JobReserved = "reserved"
+  JobBuried   = "buried"
+)
+
+type Job struct {
+  ID   string
+  Tube string
+  Body []byte
+
+  // 被Nack的次数
+  Releases int
+}
+
+// 任务队列，所有操作都指定tube，
+// beanstalk是默认实现，memory用于测试和本地开发（不需要beanstalkd）
+type Queue interface {
+  // 从tube取一个任务，timeout秒内没有可用任务返回ErrReserveTimeout
+  Reserve(tube string, timeout int) (*Job, error)
+
+  // 任务处理完成，从队列中删除
+  Ack(job *Job) error
+
+  // 任务处理失败，放回队列，delay秒后重新进入Ready状态
+  Nack(job *Job, priority, delay int) error
+
+  // 任务无法处理，不再进入Ready状态，需要人工处理（beanstalk kick）
+  Bury(job *Job, priority int) error
+
+  // 发布任务到tube，返回任务ID
+  Publish(tube string, priority, delay, ttr int, data []byte) (string, error)
+
+  // 任务的状态（JobReady/JobDelayed/JobReserved/JobBuried），
+  // 任务已经删除时返回ErrJobNotFound
+  JobState(id string) (string, error)
+
+  // 检查连接是否可用
+  Ping() error
+
+  Close() error
+}
+
+// 内存队列只有一个实例，所有的连接共享
+var sharedMemoryQueue = newMemoryQueue()
+
+// 每次调用都会建立一个新连接
+func newQueue() (Queue, error) {
+  switch strings.ToLower(Conf.Queue.Driver) {
+  case "", "beanstalk":
+    return newBeanstalkQueue(Conf.Beanstalk.Host, Conf.Beanstalk.Port)
+  case "memory":
+    return sharedMemoryQueue, nil
+  }
+  return nil, fmt.Errorf("unknown queue driver: %s", Conf.Queue.Driver)
+}
+
+// 是否是连接错误（连接断开、超时等），而不是协议错误
+func isConnError(e error) bool {
+  if e == nil {
+    return false
+  }
+  if e == io.EOF || e == io.ErrUnexpectedEOF {
+    return true
+  }
+  _, ok := e.(net.Error)
+  return ok
+}
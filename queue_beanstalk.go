@@ -0,0 +1,274 @@
+package main
+
+import (
+  "sync"
+  "time"
+
+  "github.com/kwf2030/commons/beanstalk"
+  "gopkg.in/yaml.v2"
+)
+
+const (
+  reconnectMinInterval = time.Second
+  reconnectMaxInterval = time.Minute
+)
+
+type beanstalkQueue struct {
+  host string
+  port int
+
+  // beanstalk.Conn不是并发安全的
+  l    *sync.Mutex
+  conn *beanstalk.Conn
+
+  // 连接断开时的错误，重连成功后清空，
+  // 单独加锁，Reserve阻塞时也可以检查
+  errL         *sync.Mutex
+  connErr      error
+  reconnecting bool
+  closed       bool
+
+  // 当前watch和use的tube，只有tube变化时才发送watch/use命令，
+  // 重连后会重新watch/use
+  watching string
+  using    string
+}
+
+func newBeanstalkQueue(host string, port int) (*beanstalkQueue, error) {
+  c, e := beanstalk.Dial(host, port)
+  if e != nil {
+    return nil, e
+  }
+  return &beanstalkQueue{
+    host:     host,
+    port:     port,
+    l:        &sync.Mutex{},
+    errL:     &sync.Mutex{},
+    conn:     c,
+    watching: "default",
+    using:    "default",
+  }, nil
+}
+
+func (q *beanstalkQueue) Reserve(tube string, timeout int) (*Job, error) {
+  if e := q.broken(); e != nil {
+    return nil, e
+  }
+  q.l.Lock()
+  defer q.l.Unlock()
+  if q.watching != tube {
+    e := q.watch(q.conn, tube, q.watching)
+    q.check(e)
+    if e != nil {
+      return nil, e
+    }
+    q.watching = tube
+  }
+  id, data, e := q.conn.ReserveWithTimeout(timeout)
+  q.check(e)
+  if e != nil {
+    if e == beanstalk.ErrTimedOut || e == beanstalk.ErrDeadlineSoon {
+      return nil, ErrReserveTimeout
+    }
+    return nil, e
+  }
+  job := &Job{ID: id, Tube: tube, Body: data}
+  stats, e := q.conn.StatsJob(id)
+  if e == nil {
+    v := &struct {
+      Releases int `yaml:"releases"`
+    }{}
+    if yaml.Unmarshal(stats, v) == nil {
+      job.Releases = v.Releases
+    }
+  }
+  return job, nil
+}
+
+func (q *beanstalkQueue) Ack(job *Job) error {
+  if e := q.broken(); e != nil {
+    return e
+  }
+  q.l.Lock()
+  defer q.l.Unlock()
+  return q.check(q.conn.Delete(job.ID))
+}
+
+func (q *beanstalkQueue) Nack(job *Job, priority, delay int) error {
+  if e := q.broken(); e != nil {
+    return e
+  }
+  q.l.Lock()
+  defer q.l.Unlock()
+  return q.check(q.conn.Release(job.ID, priority, delay))
+}
+
+func (q *beanstalkQueue) Bury(job *Job, priority int) error {
+  if e := q.broken(); e != nil {
+    return e
+  }
+  q.l.Lock()
+  defer q.l.Unlock()
+  return q.check(q.conn.Bury(job.ID, priority))
+}
+
+func (q *beanstalkQueue) Publish(tube string, priority, delay, ttr int, data []byte) (string, error) {
+  if e := q.broken(); e != nil {
+    return "", e
+  }
+  q.l.Lock()
+  defer q.l.Unlock()
+  if q.using != tube {
+    e := q.conn.Use(tube)
+    q.check(e)
+    if e != nil {
+      return "", e
+    }
+    q.using = tube
+  }
+  id, e := q.conn.Put(priority, delay, ttr, data)
+  q.check(e)
+  return id, e
+}
+
+func (q *beanstalkQueue) JobState(id string) (string, error) {
+  if e := q.broken(); e != nil {
+    return "", e
+  }
+  q.l.Lock()
+  defer q.l.Unlock()
+  stats, e := q.conn.StatsJob(id)
+  q.check(e)
+  if e == beanstalk.ErrNotFound {
+    return "", ErrJobNotFound
+  }
+  if e != nil {
+    return "", e
+  }
+  v := &struct {
+    State string `yaml:"state"`
+  }{}
+  e = yaml.Unmarshal(stats, v)
+  if e != nil {
+    return "", e
+  }
+  return v.State, nil
+}
+
+// 连接没有断开，并且能连接到beanstalkd
+func (q *beanstalkQueue) Ping() error {
+  if e := q.broken(); e != nil {
+    return e
+  }
+  c, e := beanstalk.Dial(q.host, q.port)
+  if e != nil {
+    return e
+  }
+  defer c.Quit()
+  _, e = c.ListTubeUsed()
+  return e
+}
+
+func (q *beanstalkQueue) Close() error {
+  q.errL.Lock()
+  q.closed = true
+  q.errL.Unlock()
+  q.l.Lock()
+  defer q.l.Unlock()
+  return q.conn.Quit()
+}
+
+func (q *beanstalkQueue) broken() error {
+  q.errL.Lock()
+  defer q.errL.Unlock()
+  return q.connErr
+}
+
+// 发现连接错误时标记连接已断开，并开始重连，
+// 重连成功之前所有操作直接返回该错误
+func (q *beanstalkQueue) check(e error) error {
+  if !isConnError(e) {
+    return e
+  }
+  q.errL.Lock()
+  defer q.errL.Unlock()
+  if q.closed {
+    return e
+  }
+  q.connErr = e
+  if !q.reconnecting {
+    q.reconnecting = true
+    logger.Error().Err(e).Msgf("beanstalk connection lost, %s:%d", q.host, q.port)
+    metricConnUp.Set(0, "queue")
+    go q.reconnect()
+  }
+  return e
+}
+
+func (q *beanstalkQueue) reconnect() {
+  d := reconnectMinInterval
+  for n := 1; ; n++ {
+    time.Sleep(d)
+    q.errL.Lock()
+    closed := q.closed
+    q.errL.Unlock()
+    if closed {
+      return
+    }
+    e := q.redial()
+    if e == nil {
+      logger.Info().Msgf("beanstalk reconnected after %d attempt(s), %s:%d", n, q.host, q.port)
+      metricConnUp.Set(1, "queue")
+      return
+    }
+    d *= 2
+    if d > reconnectMaxInterval {
+      d = reconnectMaxInterval
+    }
+    logger.Warn().Err(e).Msgf("beanstalk reconnect failed, will retry %s later", d)
+  }
+}
+
+// 建立新连接，恢复之前watch/use的tube，然后替换旧连接
+func (q *beanstalkQueue) redial() error {
+  c, e := beanstalk.Dial(q.host, q.port)
+  if e != nil {
+    return e
+  }
+  q.l.Lock()
+  defer q.l.Unlock()
+  if q.watching != "default" {
+    e = q.watch(c, q.watching, "default")
+    if e != nil {
+      c.Quit()
+      return e
+    }
+  }
+  if q.using != "default" {
+    e = c.Use(q.using)
+    if e != nil {
+      c.Quit()
+      return e
+    }
+  }
+  q.conn.Quit()
+  q.conn = c
+  q.errL.Lock()
+  q.connErr = nil
+  q.reconnecting = false
+  q.errL.Unlock()
+  return nil
+}
+
+// 只watch一个tube，否则会取到其他tube的任务
+func (q *beanstalkQueue) watch(c *beanstalk.Conn, tube, old string) error {
+  _, e := c.Watch(tube)
+  if e != nil {
+    return e
+  }
+  _, e = c.Ignore(old)
+  if e != nil && e != beanstalk.ErrNotIgnored {
+    return e
+  }
+  return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+  "strconv"
+  "sync"
+  "time"
+)
+
+type memoryJob struct {
+  id       uint64
+  tube     string
+  priority int
+  ttr      int
+  data     []byte
+  releases int
+
+  // 进入Ready状态的时间
+  readyTime time.Time
+  // 被取走后的超时时间，超过该时间没有Ack/Nack会重新进入Ready状态
+  deadline time.Time
+}
+
+// 内存队列，语义和beanstalk一致（优先级、延迟、TTR），
+// 同一个实例可以被多处共享，进程退出后数据丢失
+type memoryQueue struct {
+  l   *sync.Mutex
+  seq uint64
+
+  ready    map[string][]*memoryJob
+  reserved map[uint64]*memoryJob
+  buried   []*memoryJob
+
+  // 有新任务时close，用于唤醒阻塞的Reserve
+  notify chan struct{}
+}
+
+func newMemoryQueue() *memoryQueue {
+  return &memoryQueue{
+    l:        &sync.Mutex{},
+    ready:    make(map[string][]*memoryJob, 4),
+    reserved: make(map[uint64]*memoryJob, 16),
+    notify:   make(chan struct{}),
+  }
+}
+
+func (q *memoryQueue) Reserve(tube string, timeout int) (*Job, error) {
+  if timeout < 0 {
+    timeout = 0
+  }
+  end := time.Now().Add(time.Second * time.Duration(timeout))
+  for {
+    q.l.Lock()
+    now := time.Now()
+    d := q.expire(now)
+    j, next := q.pick(tube, now)
+    if j != nil {
+      j.deadline = now.Add(time.Second * time.Duration(j.ttr))
+      q.reserved[j.id] = j
+      q.l.Unlock()
+      return &Job{ID: strconv.FormatUint(j.id, 10), Tube: tube, Body: j.data, Releases: j.releases}, nil
+    }
+    ch := q.notify
+    q.l.Unlock()
+
+    wait := end.Sub(now)
+    if wait <= 0 {
+      return nil, ErrReserveTimeout
+    }
+    if !next.IsZero() && next.Sub(now) < wait {
+      wait = next.Sub(now)
+    }
+    if !d.IsZero() && d.Sub(now) < wait {
+      wait = d.Sub(now)
+    }
+    t := time.NewTimer(wait)
+    select {
+    case <-ch:
+    case <-t.C:
+    }
+    t.Stop()
+  }
+}
+
+func (q *memoryQueue) Ack(job *Job) error {
+  id, _ := strconv.ParseUint(job.ID, 10, 64)
+  q.l.Lock()
+  defer q.l.Unlock()
+  if _, ok := q.reserved[id]; !ok {
+    return ErrJobNotFound
+  }
+  delete(q.reserved, id)
+  return nil
+}
+
+func (q *memoryQueue) Nack(job *Job, priority, delay int) error {
+  id, _ := strconv.ParseUint(job.ID, 10, 64)
+  q.l.Lock()
+  defer q.l.Unlock()
+  j, ok := q.reserved[id]
+  if !ok {
+    return ErrJobNotFound
+  }
+  delete(q.reserved, id)
+  j.priority = priority
+  j.releases++
+  j.readyTime = time.Now().Add(time.Second * time.Duration(delay))
+  q.push(j)
+  return nil
+}
+
+func (q *memoryQueue) Bury(job *Job, priority int) error {
+  id, _ := strconv.ParseUint(job.ID, 10, 64)
+  q.l.Lock()
+  defer q.l.Unlock()
+  j, ok := q.reserved[id]
+  if !ok {
+    return ErrJobNotFound
+  }
+  delete(q.reserved, id)
+  j.priority = priority
+  q.buried = append(q.buried, j)
+  return nil
+}
+
+func (q *memoryQueue) Publish(tube string, priority, delay, ttr int, data []byte) (string, error) {
+  if ttr <= 0 {
+    ttr = 1
+  }
+  q.l.Lock()
+  defer q.l.Unlock()
+  q.seq++
+  j := &memoryJob{
+    id:        q.seq,
+    tube:      tube,
+    priority:  priority,
+    ttr:       ttr,
+    data:      data,
+    readyTime: time.Now().Add(time.Second * time.Duration(delay)),
+  }
+  q.push(j)
+  return strconv.FormatUint(j.id, 10), nil
+}
+
+func (q *memoryQueue) JobState(id string) (string, error) {
+  n, _ := strconv.ParseUint(id, 10, 64)
+  q.l.Lock()
+  defer q.l.Unlock()
+  now := time.Now()
+  q.expire(now)
+  if _, ok := q.reserved[n]; ok {
+    return JobReserved, nil
+  }
+  for _, arr := range q.ready {
+    for _, j := range arr {
+      if j.id == n {
+        if j.readyTime.After(now) {
+          return JobDelayed, nil
+        }
+        return JobReady, nil
+      }
+    }
+  }
+  for _, j := range q.buried {
+    if j.id == n {
+      return JobBuried, nil
+    }
+  }
+  return "", ErrJobNotFound
+}
+
+func (q *memoryQueue) Ping() error {
+  return nil
+}
+
+func (q *memoryQueue) Close() error {
+  return nil
+}
+
+func (q *memoryQueue) push(j *memoryJob) {
+  j.deadline = time.Time{}
+  q.ready[j.tube] = append(q.ready[j.tube], j)
+  close(q.notify)
+  q.notify = make(chan struct{})
+}
+
+// 取出tube中已就绪的优先级最高（priority最小）的任务，优先级相同先进先出，
+// 如果没有就绪的任务，返回最早就绪的时间
+func (q *memoryQueue) pick(tube string, now time.Time) (*memoryJob, time.Time) {
+  arr := q.ready[tube]
+  index := -1
+  var next time.Time
+  for i, j := range arr {
+    if j.readyTime.After(now) {
+      if next.IsZero() || j.readyTime.Before(next) {
+        next = j.readyTime
+      }
+      continue
+    }
+    if index == -1 || j.priority < arr[index].priority || (j.priority == arr[index].priority && j.id < arr[index].id) {
+      index = i
+    }
+  }
+  if index == -1 {
+    return nil, next
+  }
+  j := arr[index]
+  q.ready[tube] = append(arr[:index], arr[index+1:]...)
+  return j, next
+}
+
+// 超过TTR的任务重新进入Ready状态，返回其余任务中最早的超时时间
+func (q *memoryQueue) expire(now time.Time) time.Time {
+  var next time.Time
+  for id, j := range q.reserved {
+    if now.After(j.deadline) {
+      delete(q.reserved, id)
+      j.readyTime = now
+      q.push(j)
+      continue
+    }
+    if next.IsZero() || j.deadline.Before(next) {
+      next = j.deadline
+    }
+  }
+  return next
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/url"
+  "strconv"
+  "strings"
+  "time"
+
+  "go.etcd.io/bbolt"
+)
+
+var bucketRateLimit = []byte("ratelimit")
+
+// 令牌桶，每个来源+域名一个，保存在bolt的ratelimit bucket，
+// 重启后不会重置
+type TokenBucket struct {
+  Tokens float64   `json:"tokens"`
+  Time   time.Time `json:"time"`
+}
+
+// 一次商品检查中使用的令牌桶，结束时调用save保存
+type rateLimiter struct {
+  buckets map[string]*TokenBucket
+  changed map[string]struct{}
+}
+
+func loadRateLimiter() *rateLimiter {
+  rl := &rateLimiter{
+    buckets: make(map[string]*TokenBucket, 16),
+    changed: make(map[string]struct{}, 16),
+  }
+  e := kv.EachKV(bucketRateLimit, func(k, v []byte, n int) error {
+    b := &TokenBucket{}
+    if json.Unmarshal(v, b) == nil {
+      rl.buckets[string(k)] = b
+    }
+    return nil
+  })
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: EachKV")
+  }
+  return rl
+}
+
+// 商品所属的来源+域名还有令牌时消耗一个并返回true，
+// 来源没有配置rate时不限制
+func (rl *rateLimiter) allow(p *Product, now time.Time) bool {
+  sc := sourceConf(p.Source)
+  if sc.Rate <= 0 {
+    return true
+  }
+  burst := float64(sc.Burst)
+  if burst < 1 {
+    burst = 1
+  }
+  k := rateLimitKey(p)
+  b, ok := rl.buckets[k]
+  if !ok {
+    b = &TokenBucket{Tokens: burst, Time: now}
+    rl.buckets[k] = b
+  }
+  if now.After(b.Time) {
+    b.Tokens += now.Sub(b.Time).Minutes() * sc.Rate
+    b.Time = now
+  }
+  if b.Tokens > burst {
+    b.Tokens = burst
+  }
+  rl.changed[k] = struct{}{}
+  if b.Tokens < 1 {
+    return false
+  }
+  b.Tokens--
+  return true
+}
+
+// 消耗了令牌但没有分发的商品退还令牌
+func (rl *rateLimiter) refund(p *Product) {
+  if b, ok := rl.buckets[rateLimitKey(p)]; ok {
+    b.Tokens++
+  }
+}
+
+func (rl *rateLimiter) save() {
+  if len(rl.changed) == 0 {
+    return
+  }
+  e := kv.UpdateB(bucketRateLimit, func(b *bbolt.Bucket) error {
+    for k := range rl.changed {
+      data, _ := json.Marshal(rl.buckets[k])
+      e := b.Put([]byte(k), data)
+      if e != nil {
+        return e
+      }
+    }
+    return nil
+  })
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: UpdateB")
+  }
+}
+
+func rateLimitKey(p *Product) string {
+  return fmt.Sprintf("%d/%s", p.Source, productHost(p))
+}
+
+func productHost(p *Product) string {
+  if u, e := url.Parse(p.URL); e == nil {
+    return strings.ToLower(u.Hostname())
+  }
+  return ""
+}
+
+// 令牌桶已经用完（补充后仍然不到1个）的来源+域名，检查商品时排除
+func (rl *rateLimiter) empty(now time.Time) []SourceHost {
+  ret := make([]SourceHost, 0, 4)
+  for k, b := range rl.buckets {
+    i := strings.Index(k, "/")
+    if i < 0 {
+      continue
+    }
+    source, e := strconv.Atoi(k[:i])
+    if e != nil || k[i+1:] == "" {
+      continue
+    }
+    sc := sourceConf(source)
+    if sc.Rate <= 0 {
+      continue
+    }
+    tokens := b.Tokens
+    if now.After(b.Time) {
+      tokens += now.Sub(b.Time).Minutes() * sc.Rate
+    }
+    if tokens < 1 {
+      ret = append(ret, SourceHost{Source: source, Host: k[i+1:]})
+    }
+  }
+  return ret
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+  "fmt"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+)
+
+// 最多往后查找多久，超过了还没找到可以分发的时间（比如一直暂停），
+// 就等待scheduleRecheck后重新计算
+const (
+  scheduleHorizon = time.Hour * 24 * 8
+  scheduleRecheck = time.Hour
+)
+
+// 没有配置polling_interval时的商品分发间隔
+const defaultPollingInterval = time.Minute * 2
+
+var productSchedule *schedule
+
+// 商品分发的时间规则，按顺序匹配，第一个匹配的规则生效，
+// 都不匹配时使用polling_interval，
+// 所有时间都按times.TimeZoneSH计算
+type ScheduleRule struct {
+  // 规则名称，只用于配置错误时的提示
+  Name string `yaml:"name"`
+
+  // 以下条件都是可选的，同时配置时需要全部满足：
+  // 每天的时间段，格式为HH:MM-HH:MM，可以跨天（如23:00-08:00）
+  Window string `yaml:"window"`
+  // 星期几，0-6，0是周日
+  Weekdays []int `yaml:"weekdays"`
+  // 生效的起止时间，格式为2006-01-02 15:04
+  Start string `yaml:"start"`
+  End   string `yaml:"end"`
+
+  // 以下三个只能配置一个：
+  // 匹配时暂停分发（如网站维护期间）
+  Pause bool `yaml:"pause"`
+  // 匹配时的分发间隔（分钟）
+  Interval int `yaml:"interval"`
+  // cron表达式（分 时 日 月 周），在表达式匹配的时刻分发，
+  // 除分钟以外的字段同时也是规则的匹配条件，
+  // 如"*/5 8-9 * * 1-5"表示工作日8点到10点之间每5分钟分发一次
+  Cron string `yaml:"cron"`
+}
+
+type scheduleRule struct {
+  window   bool
+  from, to int
+  weekdays []bool
+  start    time.Time
+  end      time.Time
+  pause    bool
+  interval time.Duration
+  cron     *cronExpr
+}
+
+type schedule struct {
+  rules    []*scheduleRule
+  interval time.Duration
+}
+
+func initSchedule() {
+  s, e := newSchedule(Conf.Task.Schedules, time.Minute*time.Duration(Conf.Task.PollingInterval))
+  if e != nil {
+    panic(e)
+  }
+  productSchedule = s
+  logger.Info().Msgf("init schedule, ok, %d rules", len(s.rules))
+}
+
+// interval不大于0时使用defaultPollingInterval，避免不停地分发
+func newSchedule(rules []*ScheduleRule, interval time.Duration) (*schedule, error) {
+  if interval <= 0 {
+    interval = defaultPollingInterval
+  }
+  s := &schedule{rules: make([]*scheduleRule, 0, len(rules)), interval: interval}
+  for i, v := range rules {
+    r, e := parseScheduleRule(v)
+    if e != nil {
+      return nil, fmt.Errorf("schedule rule #%d %s: %s", i+1, v.Name, e)
+    }
+    s.rules = append(s.rules, r)
+  }
+  return s, nil
+}
+
+func parseScheduleRule(v *ScheduleRule) (*scheduleRule, error) {
+  r := &scheduleRule{pause: v.Pause}
+  n := 0
+  if v.Pause {
+    n++
+  }
+  if v.Interval > 0 {
+    r.interval = time.Minute * time.Duration(v.Interval)
+    n++
+  }
+  if v.Cron != "" {
+    c, e := parseCron(v.Cron)
+    if e != nil {
+      return nil, e
+    }
+    r.cron = c
+    n++
+  }
+  if n != 1 {
+    return nil, fmt.Errorf("exactly one of pause, interval and cron is required")
+  }
+  if v.Window != "" {
+    var h1, m1, h2, m2 int
+    _, e := fmt.Sscanf(v.Window, "%d:%d-%d:%d", &h1, &m1, &h2, &m2)
+    if e != nil || h1 > 23 || h2 > 24 || m1 > 59 || m2 > 59 || h1 < 0 || h2 < 0 || m1 < 0 || m2 < 0 {
+      return nil, fmt.Errorf("invalid window %q", v.Window)
+    }
+    r.window = true
+    r.from = h1*60 + m1
+    r.to = h2*60 + m2
+  }
+  if len(v.Weekdays) > 0 {
+    r.weekdays = make([]bool, 7)
+    for _, d := range v.Weekdays {
+      if d < 0 || d > 6 {
+        return nil, fmt.Errorf("invalid weekday %d", d)
+      }
+      r.weekdays[d] = true
+    }
+  }
+  var e error
+  if v.Start != "" {
+    r.start, e = time.ParseInLocation(times.DateTimeFormat, v.Start, times.TimeZoneSH)
+    if e != nil {
+      return nil, e
+    }
+  }
+  if v.End != "" {
+    r.end, e = time.ParseInLocation(times.DateTimeFormat, v.End, times.TimeZoneSH)
+    if e != nil {
+      return nil, e
+    }
+  }
+  return r, nil
+}
+
+func (r *scheduleRule) match(t time.Time) bool {
+  if r.window {
+    m := t.Hour()*60 + t.Minute()
+    switch {
+    case r.from < r.to:
+      if m < r.from || m >= r.to {
+        return false
+      }
+    case r.from > r.to:
+      if m < r.from && m >= r.to {
+        return false
+      }
+    }
+  }
+  if r.weekdays != nil && !r.weekdays[int(t.Weekday())] {
+    return false
+  }
+  if !r.start.IsZero() && t.Before(r.start) {
+    return false
+  }
+  if !r.end.IsZero() && !t.Before(r.end) {
+    return false
+  }
+  if r.cron != nil && !r.cron.matchHour(t) {
+    return false
+  }
+  return true
+}
+
+func (s *schedule) rule(t time.Time) *scheduleRule {
+  for _, r := range s.rules {
+    if r.match(t) {
+      return r
+    }
+  }
+  return nil
+}
+
+// 上次分发时间为last（零值表示还没分发过），计算下次分发的时间，
+// 返回的时间不早于当前时间
+func (s *schedule) next(last time.Time) time.Time {
+  return s.nextAt(last, times.Now())
+}
+
+func (s *schedule) nextAt(last, now time.Time) time.Time {
+  limit := now.Add(scheduleHorizon)
+  // 第一次检查当前时间，之后按分钟检查
+  for t := now; t.Before(limit); t = t.Truncate(time.Minute).Add(time.Minute) {
+    r := s.rule(t)
+    interval := s.interval
+    if r != nil {
+      switch {
+      case r.pause:
+        continue
+      case r.cron != nil:
+        // 同一分钟内只分发一次
+        if r.cron.match(t) && !last.Truncate(time.Minute).Equal(t.Truncate(time.Minute)) {
+          return t
+        }
+        continue
+      default:
+        interval = r.interval
+      }
+    }
+    // 间隔到期的时间在这一分钟内
+    due := last.Add(interval)
+    if due.Before(t.Truncate(time.Minute).Add(time.Minute)) {
+      if due.After(t) {
+        return due
+      }
+      return t
+    }
+  }
+  return now.Add(scheduleRecheck)
+}
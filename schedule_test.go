@@ -0,0 +1,123 @@
+package main
+
+import (
+  "testing"
+  "time"
+)
+
+// 没有配置间隔时不能立即再次分发
+func TestDefaultIntervals(t *testing.T) {
+  Conf.Task.MsgPollingInterval = 0
+  last := time.Now()
+  if d := msgInterval(last).Sub(last); d != defaultMsgPollingInterval {
+    t.Errorf("msg interval %s", d)
+  }
+  s, e := newSchedule(nil, 0)
+  if e != nil {
+    t.Fatal(e)
+  }
+  if d := s.next(last).Sub(last); d < defaultPollingInterval-time.Minute || d > defaultPollingInterval {
+    t.Errorf("product interval %s", d)
+  }
+}
+
+func TestScheduleRuleError(t *testing.T) {
+  for _, r := range []*ScheduleRule{
+    {},
+    {Pause: true, Interval: 5},
+    {Interval: 5, Cron: "* * * * *"},
+    {Cron: "* * *"},
+    {Pause: true, Window: "8:00"},
+    {Pause: true, Window: "25:00-08:00"},
+    {Pause: true, Window: "08:60-09:00"},
+    {Pause: true, Weekdays: []int{7}},
+    {Pause: true, Start: "2026-10-19"},
+  } {
+    if _, e := newSchedule([]*ScheduleRule{r}, time.Minute); e == nil {
+      t.Errorf("%+v: expected error", r)
+    }
+  }
+}
+
+func TestScheduleRuleMatch(t *testing.T) {
+  cases := []struct {
+    rule *ScheduleRule
+    t    string
+    want bool
+  }{
+    {&ScheduleRule{Window: "09:00-18:00"}, "2026-10-19 09:00", true},
+    {&ScheduleRule{Window: "09:00-18:00"}, "2026-10-19 17:59", true},
+    {&ScheduleRule{Window: "09:00-18:00"}, "2026-10-19 18:00", false},
+    {&ScheduleRule{Window: "09:00-18:00"}, "2026-10-19 08:59", false},
+    // 跨天
+    {&ScheduleRule{Window: "23:00-08:00"}, "2026-10-19 23:30", true},
+    {&ScheduleRule{Window: "23:00-08:00"}, "2026-10-19 00:00", true},
+    {&ScheduleRule{Window: "23:00-08:00"}, "2026-10-19 07:59", true},
+    {&ScheduleRule{Window: "23:00-08:00"}, "2026-10-19 08:00", false},
+    {&ScheduleRule{Window: "23:00-08:00"}, "2026-10-19 22:59", false},
+    {&ScheduleRule{Window: "20:00-24:00"}, "2026-10-19 23:59", true},
+    {&ScheduleRule{Weekdays: []int{0, 6}}, "2026-10-19 12:00", false},
+    {&ScheduleRule{Weekdays: []int{0, 6}}, "2026-11-01 12:00", true},
+    {&ScheduleRule{Start: "2026-10-19 12:00", End: "2026-10-20 00:00"}, "2026-10-19 12:00", true},
+    {&ScheduleRule{Start: "2026-10-19 12:00", End: "2026-10-20 00:00"}, "2026-10-19 11:59", false},
+    {&ScheduleRule{Start: "2026-10-19 12:00", End: "2026-10-20 00:00"}, "2026-10-20 00:00", false},
+    // cron除分钟以外的字段也是匹配条件
+    {&ScheduleRule{Cron: "*/5 8-9 * * 1-5"}, "2026-10-19 09:59", true},
+    {&ScheduleRule{Cron: "*/5 8-9 * * 1-5"}, "2026-10-19 10:00", false},
+    {&ScheduleRule{Cron: "*/5 8-9 * * 1-5"}, "2026-11-01 08:00", false},
+  }
+  for _, c := range cases {
+    if c.rule.Cron == "" {
+      c.rule.Pause = true
+    }
+    r, e := parseScheduleRule(c.rule)
+    if e != nil {
+      t.Fatalf("%+v: %s", c.rule, e)
+    }
+    if got := r.match(shTime(c.t)); got != c.want {
+      t.Errorf("%+v at %s: got %v, want %v", c.rule, c.t, got, c.want)
+    }
+  }
+}
+
+func TestScheduleNext(t *testing.T) {
+  // 2026-10-19是周一
+  now := shTime("2026-10-19 10:00").Add(time.Second * 30)
+  cases := []struct {
+    name  string
+    rules []*ScheduleRule
+    last  time.Time
+    now   time.Time
+    want  time.Time
+  }{
+    {"first time", nil, time.Time{}, now, now},
+    {"interval due later", nil, now.Add(-time.Minute), now, now.Add(time.Minute * 14)},
+    {"interval overdue", nil, now.Add(-time.Hour), now, now},
+    {"rule interval", []*ScheduleRule{{Window: "10:00-11:00", Interval: 30}}, now.Add(-time.Minute * 10), now, now.Add(time.Minute * 20)},
+    // 规则按顺序匹配，第一个匹配的生效
+    {"first rule wins", []*ScheduleRule{{Window: "10:00-11:00", Interval: 30}, {Pause: true}}, now.Add(-time.Minute * 10), now, now.Add(time.Minute * 20)},
+    // 暂停结束后立即分发
+    {"pause then resume", []*ScheduleRule{{Window: "10:00-12:00", Pause: true}}, now.Add(-time.Minute * 10), now, shTime("2026-10-19 12:00")},
+    // 暂停结束时间隔还没到期，等到期再分发
+    {"resume before due", []*ScheduleRule{{Window: "09:00-10:05", Pause: true}, {Interval: 30}}, now.Add(-time.Minute * 10), now, now.Add(time.Minute * 20)},
+    // 跨天暂停
+    {"pause across midnight", []*ScheduleRule{{Window: "22:00-06:00", Pause: true}}, now.Add(-time.Hour), shTime("2026-10-19 23:00"), shTime("2026-10-20 06:00")},
+    {"pause weekend", []*ScheduleRule{{Weekdays: []int{0, 6}, Pause: true}}, now.Add(-time.Hour), shTime("2026-10-24 12:00"), shTime("2026-10-26 00:00")},
+    {"always paused", []*ScheduleRule{{Pause: true}}, now.Add(-time.Hour), now, now.Add(scheduleRecheck)},
+    {"cron now", []*ScheduleRule{{Cron: "*/15 10-11 * * *"}}, time.Time{}, now, now},
+    // 同一分钟内只分发一次
+    {"cron same minute", []*ScheduleRule{{Cron: "*/15 10-11 * * *"}}, now.Add(-time.Second * 20), now, shTime("2026-10-19 10:15")},
+    // cron范围外使用polling_interval
+    {"cron out of range", []*ScheduleRule{{Cron: "*/15 10-11 * * *"}}, shTime("2026-10-19 11:45"), shTime("2026-10-19 11:50"), shTime("2026-10-19 12:00")},
+    {"cron next day", []*ScheduleRule{{Cron: "0 8 * * *"}, {Pause: true}}, now, now, shTime("2026-10-20 08:00")},
+  }
+  for _, c := range cases {
+    s, e := newSchedule(c.rules, time.Minute*15)
+    if e != nil {
+      t.Fatalf("%s: %s", c.name, e)
+    }
+    if got := s.nextAt(c.last, c.now); !got.Equal(c.want) {
+      t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+    }
+  }
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+  "os"
+  "sync"
+  "time"
+)
+
+// 没有配置shutdown_timeout时等待当前任务处理完成的最长时间
+const defaultShutdownTimeout = time.Second * 30
+
+var (
+  // 收到退出信号时close
+  stopChan = make(chan struct{})
+
+  // run()退出时close
+  runDone = make(chan struct{})
+
+  // 已经取出但还没有处理完的report任务
+  reservedL    = &sync.Mutex{}
+  reservedJobs = make(map[*Job]Queue, 4)
+)
+
+func stopping() bool {
+  select {
+  case <-stopChan:
+    return true
+  default:
+    return false
+  }
+}
+
+func trackJob(q Queue, job *Job) {
+  reservedL.Lock()
+  reservedJobs[job] = q
+  reservedL.Unlock()
+}
+
+func untrackJob(job *Job) {
+  reservedL.Lock()
+  delete(reservedJobs, job)
+  reservedL.Unlock()
+}
+
+// 停止调度，等待当前的处理完成（最多shutdown_timeout秒），
+// 超时没有处理完的report任务放回队列，再等待最多shutdown_timeout秒让worker退出，
+// 仍然没有退出时不关闭存储直接结束进程（outbox保证重启后不会丢失任务和消息），
+// 最后同步bolt
+func shutdown() {
+  close(stopChan)
+
+  d := time.Second * time.Duration(Conf.Task.ShutdownTimeout)
+  if d <= 0 {
+    d = defaultShutdownTimeout
+  }
+  select {
+  case <-runDone:
+    logger.Info().Msg("shutdown, current cycle finished")
+  case <-time.After(d):
+    logger.Warn().Msgf("shutdown, current cycle not finished in %s", d)
+    reservedL.Lock()
+    for job, q := range reservedJobs {
+      e := q.Nack(job, Conf.Beanstalk.PutTubePriority, 0)
+      if e != nil {
+        logger.Error().Err(e).Msgf("ERR: Nack, job id=%s", job.ID)
+        continue
+      }
+      logger.Info().Msgf("shutdown, release job, job id=%s", job.ID)
+    }
+    reservedL.Unlock()
+
+    // worker还在使用存储，不能返回（返回后会关闭存储）
+    select {
+    case <-runDone:
+      logger.Info().Msg("shutdown, current cycle finished after releasing jobs")
+    case <-time.After(d):
+      logger.Error().Msgf("shutdown, workers not stopped in %s, exit without closing stores", d)
+      if e := kv.DB.Sync(); e != nil {
+        logger.Error().Err(e).Msg("ERR: Sync")
+      }
+      os.Exit(1)
+    }
+  }
+
+  e := kv.DB.Sync()
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: Sync")
+  }
+  logger.Info().Msg("shutdown, ok")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+  "sync"
+  "time"
+)
+
+var (
+  // 每个来源最近一次发布抓取任务的时间
+  sourceLastPut  = make(map[int]time.Time, 8)
+  sourceLastPutL = &sync.Mutex{}
+)
+
+// 来源的配置，没有配置的来源使用put_tube_task和task.overload
+func sourceConf(source int) *SourceConf {
+  for _, v := range Conf.Sources {
+    if v.Source == source {
+      ret := *v
+      if ret.Tube == "" {
+        ret.Tube = Conf.Beanstalk.PutTubeTask
+      }
+      if ret.Overload <= 0 {
+        ret.Overload = Conf.Task.Overload
+      }
+      return &ret
+    }
+  }
+  return &SourceConf{Source: source, Tube: Conf.Beanstalk.PutTubeTask, Overload: Conf.Task.Overload}
+}
+
+// 距离上次分发还不到interval的来源，检查商品时排除
+func limitedSources(now time.Time) []int {
+  sourceLastPutL.Lock()
+  defer sourceLastPutL.Unlock()
+  ret := make([]int, 0, 2)
+  for _, v := range Conf.Sources {
+    if v.Interval > 0 && now.Sub(sourceLastPut[v.Source]) < time.Second*time.Duration(v.Interval) {
+      ret = append(ret, v.Source)
+    }
+  }
+  return ret
+}
+
+// 记录来源的分发时间
+func markSourcePut(source int, now time.Time) {
+  sourceLastPutL.Lock()
+  sourceLastPut[source] = now
+  sourceLastPutL.Unlock()
+}
+
+// 按来源分组，保持原来的顺序
+func groupBySource(arr []*scoredPayload) ([]int, map[int][]*scoredPayload) {
+  sources := make([]int, 0, 4)
+  m := make(map[int][]*scoredPayload, 4)
+  for _, v := range arr {
+    s := v.payload.Product.Source
+    if _, ok := m[s]; !ok {
+      sources = append(sources, s)
+    }
+    m[s] = append(m[s], v)
+  }
+  return sources, m
+}
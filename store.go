@@ -0,0 +1,127 @@
+package main
+
+import (
+  "fmt"
+  "strings"
+  "time"
+)
+
+// msg表的一条记录
+type MsgRecord struct {
+  AID  uint64
+  Type int
+  Msg  *Message
+}
+
+// notify_ledger表的记录，每条是一个已经推送的通知
+type NotifyRecord struct {
+  UserID     string
+  ProductID  string
+  Event      string
+  Currency   int
+  Price      float64
+  PriceLow   float64
+  PriceHigh  float64
+  NotifyTime time.Time
+}
+
+// 用户关注商品之后某种事件的通知情况
+type NotifyState struct {
+  // 最近一次通知的时间
+  LastTime time.Time
+  // 通知过的最低价格
+  LowestPrice float64
+}
+
+// 来源+域名（URL的host，小写），令牌桶用完时检查商品排除
+type SourceHost struct {
+  Source int
+  Host   string
+}
+
+// msg/product/product_update/product_watch表的读写，
+// mysql是默认实现，memory用于测试和本地开发（不需要MariaDB）
+type Store interface {
+  // _id大于after的消息（文本和分享），按_id升序，最多limit条
+  NextMessages(after uint64, limit int) ([]*MsgRecord, error)
+
+  // 按(last_dispatch_time, _id)升序排在after之后（after为nil时从头开始）的商品，
+  // 要求url不为空、没有失效且last_dispatch_time早于before（before为零值时不检查），
+  // 并且next_dispatch_time为空或者不晚于due（due为零值时不检查），
+  // 排除来源在excludeSources中的商品和来源+域名在excludeHosts中的商品，最多limit条，
+  // 只包含_id/id/url/source/price/update_time/last_dispatch_time字段
+  NextProductsDue(after *Product, before, due time.Time, excludeSources []int, excludeHosts []SourceHost, limit int) ([]*Product, error)
+
+  // 更新商品的last_dispatch_time
+  SaveDispatchTime(aids []uint64, t time.Time) error
+
+  // 更新商品的next_dispatch_time
+  SaveNextDispatchTime(productID string, t time.Time) error
+
+  // 最近一次处理的抓取结果的抓取时间（product.report_time），没有时返回零值
+  ReportTime(productID string) (time.Time, error)
+
+  // 更新商品的report_time，只会往后更新
+  SaveReportTime(productID string, t time.Time) error
+
+  // 商品抓取失败次数加1，达到maxFailures时标记为失效（maxFailures为0时不标记），
+  // 返回失败次数和是否失效
+  RecordProductFailure(productID string, maxFailures int) (int, bool, error)
+
+  // 抓取成功时清空失败次数（失效的商品恢复）
+  ClearProductFailure(productID string) error
+
+  // 消息的发送者和发送时间，消息不存在时返回空字符串
+  MessageSender(msgID string) (string, time.Time, error)
+
+  // 新增关注记录（不存在时），或者重新关注（已取消关注时）
+  UpsertWatch(userID string, p *Product, watchTime time.Time) error
+
+  // 商品最近一次的更新记录，不存在时返回nil
+  LatestUpdate(productID string) (*Product, error)
+
+  // 新增product_update记录，并新增或更新product记录
+  RecordProductUpdate(p *Product) error
+
+  // 商品信息，不存在时返回nil
+  GetProduct(productID string) (*Product, error)
+
+  // 商品的所有关注者（state为关注）
+  WatchersOf(productID string) ([]*ProductWatch, error)
+
+  // 多个商品的所有关注者（state为关注），按商品ID分组
+  WatchersOfProducts(productIDs []string) (map[string][]*ProductWatch, error)
+
+  // 商品的关注人数（state为关注）
+  CountWatchers(productID string) (int, error)
+
+  // 用户的语言（user_locale表），没有设置的用户不在返回结果中
+  UserLocales(userIDs []string) (map[string]string, error)
+
+  // 新增notify_ledger记录
+  RecordNotifications(arr []*NotifyRecord) error
+
+  // 商品的关注者在关注（watch_time）之后收到的通知，按用户ID和事件类型分组
+  NotifyStates(productID string) (map[string]map[string]*NotifyState, error)
+
+  // 商品从since开始的product_update记录数（即价格变动次数）
+  CountUpdates(productID string, since time.Time) (int, error)
+
+  // 在同一个事务中执行f，f返回error时回滚，否则提交
+  Tx(f func(s Store) error) error
+
+  // 检查连接是否可用
+  Ping() error
+
+  Close() error
+}
+
+func newStore() (Store, error) {
+  switch strings.ToLower(Conf.Database.Driver) {
+  case "", "mysql":
+    return newMySQLStore(db), nil
+  case "memory":
+    return newMemoryStore(), nil
+  }
+  return nil, fmt.Errorf("unknown database driver: %s", Conf.Database.Driver)
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+  "sort"
+  "sync"
+  "time"
+)
+
+type memoryMsg struct {
+  MsgRecord
+  fromUserID string
+  createTime time.Time
+}
+
+type memoryProduct struct {
+  p                *Product
+  lastDispatchTime time.Time
+  nextDispatchTime time.Time
+  reportTime       time.Time
+  failCount        int
+  dead             bool
+}
+
+type memoryData struct {
+  aid      uint64
+  msgs     []*memoryMsg
+  products map[string]*memoryProduct
+  updates  map[string][]*Product
+  watches  []*ProductWatch
+  locales  map[string]string
+  ledger   []*NotifyRecord
+}
+
+func (d *memoryData) clone() *memoryData {
+  ret := &memoryData{
+    aid:      d.aid,
+    msgs:     append([]*memoryMsg(nil), d.msgs...),
+    products: make(map[string]*memoryProduct, len(d.products)),
+    updates:  make(map[string][]*Product, len(d.updates)),
+    watches:  make([]*ProductWatch, 0, len(d.watches)),
+    locales:  make(map[string]string, len(d.locales)),
+    ledger:   append([]*NotifyRecord(nil), d.ledger...),
+  }
+  for k, v := range d.products {
+    p := *v.p
+    mp := *v
+    mp.p = &p
+    ret.products[k] = &mp
+  }
+  for k, v := range d.updates {
+    ret.updates[k] = append([]*Product(nil), v...)
+  }
+  for _, v := range d.watches {
+    pw := *v
+    ret.watches = append(ret.watches, &pw)
+  }
+  for k, v := range d.locales {
+    ret.locales[k] = v
+  }
+  return ret
+}
+
+// 内存存储，进程退出后数据丢失，
+// 事务通过整体复制实现，f返回error时恢复到复制前的数据
+type memoryStore struct {
+  l *sync.Mutex
+  d *memoryData
+
+  // 在事务中时已经持有锁
+  inTx bool
+}
+
+func newMemoryStore() *memoryStore {
+  return &memoryStore{
+    l: &sync.Mutex{},
+    d: &memoryData{
+      products: make(map[string]*memoryProduct, 64),
+      updates:  make(map[string][]*Product, 64),
+      locales:  make(map[string]string, 16),
+    },
+  }
+}
+
+func (s *memoryStore) lock() func() {
+  if s.inTx {
+    return func() {}
+  }
+  s.l.Lock()
+  return s.l.Unlock
+}
+
+// 新增消息（相当于用户发送了一条消息）
+func (s *memoryStore) addMessage(msgType int, msg *Message, fromUserID string, createTime time.Time) uint64 {
+  defer s.lock()()
+  s.d.aid++
+  m := *msg
+  s.d.msgs = append(s.d.msgs, &memoryMsg{
+    MsgRecord:  MsgRecord{AID: s.d.aid, Type: msgType, Msg: &m},
+    fromUserID: fromUserID,
+    createTime: createTime,
+  })
+  return s.d.aid
+}
+
+// 新增或覆盖关注记录
+func (s *memoryStore) addWatch(pw *ProductWatch) {
+  defer s.lock()()
+  v := *pw
+  for i, w := range s.d.watches {
+    if w.UserID == pw.UserID && w.ProductID == pw.ProductID {
+      s.d.watches[i] = &v
+      return
+    }
+  }
+  s.d.watches = append(s.d.watches, &v)
+}
+
+// 设置用户的语言
+func (s *memoryStore) setUserLocale(userID, locale string) {
+  defer s.lock()()
+  s.d.locales[userID] = locale
+}
+
+func (s *memoryStore) NextMessages(after uint64, limit int) ([]*MsgRecord, error) {
+  defer s.lock()()
+  ret := make([]*MsgRecord, 0, limit)
+  for _, m := range s.d.msgs {
+    if len(ret) >= limit {
+      break
+    }
+    if m.AID <= after || (m.Type != 1 && m.Type != MsgLink) {
+      continue
+    }
+    msg := *m.Msg
+    ret = append(ret, &MsgRecord{AID: m.AID, Type: m.Type, Msg: &msg})
+  }
+  return ret, nil
+}
+
+func (s *memoryStore) NextProductsDue(after *Product, before, due time.Time, excludeSources []int, excludeHosts []SourceHost, limit int) ([]*Product, error) {
+  defer s.lock()()
+  excluded := make(map[int]struct{}, len(excludeSources))
+  for _, v := range excludeSources {
+    excluded[v] = struct{}{}
+  }
+  excludedHosts := make(map[SourceHost]struct{}, len(excludeHosts))
+  for _, v := range excludeHosts {
+    excludedHosts[v] = struct{}{}
+  }
+  arr := make([]*memoryProduct, 0, len(s.d.products))
+  for _, v := range s.d.products {
+    if v.p.URL == "" || v.dead {
+      continue
+    }
+    if _, ok := excluded[v.p.Source]; ok {
+      continue
+    }
+    if _, ok := excludedHosts[SourceHost{v.p.Source, productHost(v.p)}]; ok {
+      continue
+    }
+    if after != nil && !rotationAfter(v.lastDispatchTime, v.p.AID, after.LastDispatchTime, after.AID) {
+      continue
+    }
+    if !before.IsZero() && !v.lastDispatchTime.Before(before) {
+      continue
+    }
+    if !due.IsZero() && v.nextDispatchTime.After(due) {
+      continue
+    }
+    arr = append(arr, v)
+  }
+  sort.Slice(arr, func(i, j int) bool {
+    return rotationAfter(arr[j].lastDispatchTime, arr[j].p.AID, arr[i].lastDispatchTime, arr[i].p.AID)
+  })
+  if len(arr) > limit {
+    arr = arr[:limit]
+  }
+  ret := make([]*Product, 0, len(arr))
+  for _, v := range arr {
+    ret = append(ret, &Product{AID: v.p.AID, ID: v.p.ID, URL: v.p.URL, Source: v.p.Source, Price: v.p.Price, UpdateTime: v.p.UpdateTime, LastDispatchTime: v.lastDispatchTime})
+  }
+  return ret, nil
+}
+
+// (t1, aid1)是否排在(t2, aid2)之后，
+// 和mysql一样last_dispatch_time只精确到秒
+func rotationAfter(t1 time.Time, aid1 uint64, t2 time.Time, aid2 uint64) bool {
+  t1 = t1.Truncate(time.Second)
+  t2 = t2.Truncate(time.Second)
+  if t1.Equal(t2) {
+    return aid1 > aid2
+  }
+  return t1.After(t2)
+}
+
+func (s *memoryStore) SaveDispatchTime(aids []uint64, t time.Time) error {
+  defer s.lock()()
+  m := make(map[uint64]struct{}, len(aids))
+  for _, v := range aids {
+    m[v] = struct{}{}
+  }
+  for _, v := range s.d.products {
+    if _, ok := m[v.p.AID]; ok {
+      v.lastDispatchTime = t
+    }
+  }
+  return nil
+}
+
+func (s *memoryStore) SaveNextDispatchTime(productID string, t time.Time) error {
+  defer s.lock()()
+  if v, ok := s.d.products[productID]; ok {
+    v.nextDispatchTime = t
+  }
+  return nil
+}
+
+func (s *memoryStore) RecordProductFailure(productID string, maxFailures int) (int, bool, error) {
+  defer s.lock()()
+  v, ok := s.d.products[productID]
+  if !ok {
+    return 0, false, nil
+  }
+  v.failCount++
+  v.dead = maxFailures > 0 && v.failCount >= maxFailures
+  return v.failCount, v.dead, nil
+}
+
+func (s *memoryStore) ReportTime(productID string) (time.Time, error) {
+  defer s.lock()()
+  if v, ok := s.d.products[productID]; ok {
+    return v.reportTime, nil
+  }
+  return time.Time{}, nil
+}
+
+func (s *memoryStore) SaveReportTime(productID string, t time.Time) error {
+  defer s.lock()()
+  if v, ok := s.d.products[productID]; ok && v.reportTime.Before(t) {
+    v.reportTime = t
+  }
+  return nil
+}
+
+func (s *memoryStore) ClearProductFailure(productID string) error {
+  defer s.lock()()
+  if v, ok := s.d.products[productID]; ok {
+    v.failCount = 0
+    v.dead = false
+  }
+  return nil
+}
+
+func (s *memoryStore) MessageSender(msgID string) (string, time.Time, error) {
+  defer s.lock()()
+  for _, m := range s.d.msgs {
+    if m.Msg.ID == msgID {
+      return m.fromUserID, m.createTime, nil
+    }
+  }
+  return "", time.Time{}, nil
+}
+
+func (s *memoryStore) UpsertWatch(userID string, p *Product, watchTime time.Time) error {
+  defer s.lock()()
+  for _, w := range s.d.watches {
+    if w.UserID == userID && w.ProductID == p.ID {
+      if w.State == StateUnWatch {
+        w.WatchTime = watchTime
+        w.State = StateWatch
+      }
+      return nil
+    }
+  }
+  s.d.watches = append(s.d.watches, &ProductWatch{
+    UserID:    userID,
+    ProductID: p.ID,
+    Currency:  p.Currency,
+    Price:     p.Price,
+    PriceLow:  p.PriceLow,
+    PriceHigh: p.PriceHigh,
+    Stock:     p.Stock,
+    WatchTime: watchTime,
+    State:     StateWatch,
+  })
+  return nil
+}
+
+func (s *memoryStore) LatestUpdate(productID string) (*Product, error) {
+  defer s.lock()()
+  var ret *Product
+  for _, v := range s.d.updates[productID] {
+    if ret == nil || !v.UpdateTime.Before(ret.UpdateTime) {
+      ret = v
+    }
+  }
+  if ret == nil {
+    return nil, nil
+  }
+  p := *ret
+  return &p, nil
+}
+
+func (s *memoryStore) RecordProductUpdate(p *Product) error {
+  defer s.lock()()
+  u := *p
+  s.d.updates[p.ID] = append(s.d.updates[p.ID], &u)
+  if v, ok := s.d.products[p.ID]; ok {
+    np := *p
+    np.AID = v.p.AID
+    v.p = &np
+    return nil
+  }
+  s.d.aid++
+  np := *p
+  np.AID = s.d.aid
+  s.d.products[p.ID] = &memoryProduct{p: &np, lastDispatchTime: p.UpdateTime}
+  return nil
+}
+
+func (s *memoryStore) GetProduct(productID string) (*Product, error) {
+  defer s.lock()()
+  v, ok := s.d.products[productID]
+  if !ok {
+    return nil, nil
+  }
+  p := *v.p
+  return &p, nil
+}
+
+func (s *memoryStore) WatchersOf(productID string) ([]*ProductWatch, error) {
+  defer s.lock()()
+  ret := make([]*ProductWatch, 0, 8)
+  for _, w := range s.d.watches {
+    if w.ProductID == productID && w.State == StateWatch {
+      pw := *w
+      ret = append(ret, &pw)
+    }
+  }
+  return ret, nil
+}
+
+func (s *memoryStore) WatchersOfProducts(productIDs []string) (map[string][]*ProductWatch, error) {
+  defer s.lock()()
+  m := make(map[string]struct{}, len(productIDs))
+  for _, v := range productIDs {
+    m[v] = struct{}{}
+  }
+  ret := make(map[string][]*ProductWatch, len(productIDs))
+  for _, w := range s.d.watches {
+    if _, ok := m[w.ProductID]; ok && w.State == StateWatch {
+      pw := *w
+      ret[w.ProductID] = append(ret[w.ProductID], &pw)
+    }
+  }
+  return ret, nil
+}
+
+func (s *memoryStore) CountWatchers(productID string) (int, error) {
+  defer s.lock()()
+  ret := 0
+  for _, w := range s.d.watches {
+    if w.ProductID == productID && w.State == StateWatch {
+      ret++
+    }
+  }
+  return ret, nil
+}
+
+func (s *memoryStore) UserLocales(userIDs []string) (map[string]string, error) {
+  defer s.lock()()
+  ret := make(map[string]string, len(userIDs))
+  for _, v := range userIDs {
+    if locale, ok := s.d.locales[v]; ok {
+      ret[v] = locale
+    }
+  }
+  return ret, nil
+}
+
+func (s *memoryStore) RecordNotifications(arr []*NotifyRecord) error {
+  defer s.lock()()
+  for _, v := range arr {
+    r := *v
+    s.d.ledger = append(s.d.ledger, &r)
+  }
+  return nil
+}
+
+func (s *memoryStore) NotifyStates(productID string) (map[string]map[string]*NotifyState, error) {
+  defer s.lock()()
+  watchTimes := make(map[string]time.Time, 16)
+  for _, w := range s.d.watches {
+    if w.ProductID == productID && w.State == StateWatch {
+      watchTimes[w.UserID] = w.WatchTime
+    }
+  }
+  ret := make(map[string]map[string]*NotifyState, 16)
+  for _, r := range s.d.ledger {
+    wt, ok := watchTimes[r.UserID]
+    if r.ProductID != productID || !ok || r.NotifyTime.Before(wt) {
+      continue
+    }
+    if _, ok := ret[r.UserID]; !ok {
+      ret[r.UserID] = make(map[string]*NotifyState, 2)
+    }
+    st, ok := ret[r.UserID][r.Event]
+    if !ok {
+      ret[r.UserID][r.Event] = &NotifyState{LastTime: r.NotifyTime, LowestPrice: r.Price}
+      continue
+    }
+    if r.NotifyTime.After(st.LastTime) {
+      st.LastTime = r.NotifyTime
+    }
+    if r.Price < st.LowestPrice {
+      st.LowestPrice = r.Price
+    }
+  }
+  return ret, nil
+}
+
+func (s *memoryStore) CountUpdates(productID string, since time.Time) (int, error) {
+  defer s.lock()()
+  ret := 0
+  for _, v := range s.d.updates[productID] {
+    if !v.UpdateTime.Before(since) {
+      ret++
+    }
+  }
+  return ret, nil
+}
+
+func (s *memoryStore) Tx(f func(s Store) error) error {
+  if s.inTx {
+    return f(s)
+  }
+  s.l.Lock()
+  defer s.l.Unlock()
+  snapshot := s.d.clone()
+  e := f(&memoryStore{l: s.l, d: s.d, inTx: true})
+  if e != nil {
+    *s.d = *snapshot
+  }
+  return e
+}
+
+func (s *memoryStore) Ping() error {
+  return nil
+}
+
+func (s *memoryStore) Close() error {
+  return nil
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "encoding/json"
+  "strings"
+  "time"
+
+  "github.com/go-sql-driver/mysql"
+  "github.com/kwf2030/commons/times"
+)
+
+// *sql.DB和*sql.Tx共有的方法
+type querier interface {
+  Exec(query string, args ...interface{}) (sql.Result, error)
+  Query(query string, args ...interface{}) (*sql.Rows, error)
+  QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type mysqlStore struct {
+  db *sql.DB
+  q  querier
+}
+
+func newMySQLStore(db *sql.DB) *mysqlStore {
+  return &mysqlStore{db: db, q: db}
+}
+
+func (s *mysqlStore) NextMessages(after uint64, limit int) ([]*MsgRecord, error) {
+  rows, e := s.q.Query(`SELECT _id, id, type, content, url FROM msg WHERE _id>? AND (type=1 OR type=49) LIMIT ?`, after, limit)
+  if e != nil {
+    return nil, e
+  }
+  defer rows.Close()
+  ret := make([]*MsgRecord, 0, limit)
+  for rows.Next() {
+    r := &MsgRecord{Msg: &Message{}}
+    e := rows.Scan(&r.AID, &r.Msg.ID, &r.Type, &r.Msg.Content, &r.Msg.URL)
+    if e != nil {
+      return ret, e
+    }
+    ret = append(ret, r)
+  }
+  return ret, rows.Err()
+}
+
+func (s *mysqlStore) NextProductsDue(after *Product, before, due time.Time, excludeSources []int, excludeHosts []SourceHost, limit int) ([]*Product, error) {
+  query := `SELECT _id, id, url, source, price, update_time, last_dispatch_time FROM product WHERE url<>'' AND dead=0`
+  args := make([]interface{}, 0, 6+len(excludeSources)+len(excludeHosts)*3)
+  if after != nil {
+    t := after.LastDispatchTime.Format(times.DateTimeSFormat)
+    query += ` AND (last_dispatch_time>? OR (last_dispatch_time=? AND _id>?))`
+    args = append(args, t, t, after.AID)
+  }
+  if !before.IsZero() {
+    query += ` AND last_dispatch_time<?`
+    args = append(args, before.Format(times.DateTimeSFormat))
+  }
+  if !due.IsZero() {
+    query += ` AND (next_dispatch_time IS NULL OR next_dispatch_time<=?)`
+    args = append(args, due.Format(times.DateTimeSFormat))
+  }
+  if len(excludeSources) > 0 {
+    query += ` AND source NOT IN (?` + strings.Repeat(`, ?`, len(excludeSources)-1) + `)`
+    for _, v := range excludeSources {
+      args = append(args, v)
+    }
+  }
+  // 带端口或者userinfo的URL不会被排除，查询后仍然按令牌桶跳过
+  for _, v := range excludeHosts {
+    h := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(v.Host)
+    query += ` AND NOT (source=? AND (url LIKE ? OR url LIKE ?))`
+    args = append(args, v.Source, "http://"+h+"/%", "https://"+h+"/%")
+  }
+  query += ` ORDER BY last_dispatch_time, _id LIMIT ?`
+  args = append(args, limit)
+  rows, e := s.q.Query(query, args...)
+  if e != nil {
+    return nil, e
+  }
+  defer rows.Close()
+  ret := make([]*Product, 0, limit)
+  for rows.Next() {
+    p := &Product{}
+    e := rows.Scan(&p.AID, &p.ID, &p.URL, &p.Source, &p.Price, &p.UpdateTime, &p.LastDispatchTime)
+    if e != nil {
+      return ret, e
+    }
+    ret = append(ret, p)
+  }
+  return ret, rows.Err()
+}
+
+func (s *mysqlStore) SaveDispatchTime(aids []uint64, t time.Time) error {
+  str := t.Format(times.DateTimeSFormat)
+  for _, v := range aids {
+    _, e := s.q.Exec(`UPDATE product SET last_dispatch_time=? WHERE _id=?`, str, v)
+    if e != nil {
+      return e
+    }
+  }
+  return nil
+}
+
+func (s *mysqlStore) SaveNextDispatchTime(productID string, t time.Time) error {
+  _, e := s.q.Exec(`UPDATE product SET next_dispatch_time=? WHERE id=?`, t.Format(times.DateTimeSFormat), productID)
+  return e
+}
+
+func (s *mysqlStore) RecordProductFailure(productID string, maxFailures int) (int, bool, error) {
+  // fail_count先更新，dead使用更新后的值
+  _, e := s.q.Exec(`UPDATE product SET fail_count=fail_count+1, dead=(?>0 AND fail_count>=?) WHERE id=?`, maxFailures, maxFailures, productID)
+  if e != nil {
+    return 0, false, e
+  }
+  var n int
+  var dead bool
+  e = s.q.QueryRow(`SELECT fail_count, dead FROM product WHERE id=? LIMIT 1`, productID).Scan(&n, &dead)
+  if e == sql.ErrNoRows {
+    return 0, false, nil
+  }
+  return n, dead, e
+}
+
+func (s *mysqlStore) ReportTime(productID string) (time.Time, error) {
+  var t mysql.NullTime
+  e := s.q.QueryRow(`SELECT report_time FROM product WHERE id=? LIMIT 1`, productID).Scan(&t)
+  if e != nil && e != sql.ErrNoRows {
+    return time.Time{}, e
+  }
+  return t.Time, nil
+}
+
+func (s *mysqlStore) SaveReportTime(productID string, t time.Time) error {
+  str := t.Format(times.DateTimeSFormat)
+  _, e := s.q.Exec(`UPDATE product SET report_time=? WHERE id=? AND (report_time IS NULL OR report_time<?)`, str, productID, str)
+  return e
+}
+
+func (s *mysqlStore) ClearProductFailure(productID string) error {
+  _, e := s.q.Exec(`UPDATE product SET fail_count=0, dead=0 WHERE id=? AND fail_count>0`, productID)
+  return e
+}
+
+func (s *mysqlStore) MessageSender(msgID string) (string, time.Time, error) {
+  var uid string
+  var ct time.Time
+  e := s.q.QueryRow(`SELECT from_user_id, create_time FROM msg WHERE id=? LIMIT 1`, msgID).Scan(&uid, &ct)
+  if e == sql.ErrNoRows {
+    return "", ct, nil
+  }
+  return uid, ct, e
+}
+
+func (s *mysqlStore) UpsertWatch(userID string, p *Product, watchTime time.Time) error {
+  wt := watchTime.Format(times.DateTimeSFormat)
+  var aid uint64
+  var state int
+  e := s.q.QueryRow(`SELECT _id, state FROM product_watch WHERE user_id=? AND product_id=? LIMIT 1`, userID, p.ID).Scan(&aid, &state)
+  if e != nil && e != sql.ErrNoRows {
+    return e
+  }
+  if aid == 0 {
+    _, e = s.q.Exec(`INSERT INTO product_watch (user_id, product_id, currency, price, price_low, price_high, stock, watch_time, state) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+      userID, p.ID, p.Currency, p.Price,
+      p.PriceLow, p.PriceHigh, p.Stock, wt, StateWatch)
+    return e
+  }
+  if state == StateUnWatch {
+    _, e = s.q.Exec(`UPDATE product_watch SET watch_time=?, state=? WHERE user_id=? AND product_id=?`, wt, StateWatch, userID, p.ID)
+    return e
+  }
+  return nil
+}
+
+func (s *mysqlStore) LatestUpdate(productID string) (*Product, error) {
+  p := &Product{ID: productID}
+  e := s.q.QueryRow(`SELECT price, price_low, price_high, stock, update_time FROM product_update WHERE id=? ORDER BY update_time DESC LIMIT 1`, productID).Scan(&p.Price, &p.PriceLow, &p.PriceHigh, &p.Stock, &p.UpdateTime)
+  if e == sql.ErrNoRows {
+    return nil, nil
+  }
+  if e != nil {
+    return nil, e
+  }
+  return p, nil
+}
+
+func (s *mysqlStore) RecordProductUpdate(p *Product) error {
+  ut := p.UpdateTime.Format(times.DateTimeSFormat)
+  var comments string
+  if p.Comments.Total > 0 {
+    data, _ := json.Marshal(p.Comments)
+    comments = string(data)
+  }
+  _, e := s.q.Exec(`INSERT INTO product_update (id, source, url, short_url, title, currency, price, price_low, price_high, stock, sales, category, comments, update_time) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+    p.ID, p.Source, p.URL, p.ShortURL, p.Title,
+    p.Currency, p.Price, p.PriceLow, p.PriceHigh, p.Stock,
+    p.Sales, p.Category, comments, ut)
+  if e != nil {
+    return e
+  }
+
+  var aid uint64
+  e = s.q.QueryRow(`SELECT _id FROM product WHERE id=? LIMIT 1`, p.ID).Scan(&aid)
+  if e != nil && e != sql.ErrNoRows {
+    return e
+  }
+  if aid == 0 {
+    // 新增记录时注意要加上last_dispatch_time字段
+    _, e = s.q.Exec(`INSERT INTO product (id, source, url, short_url, title, currency, price, price_low, price_high, stock, sales, category, comments, update_time, last_dispatch_time) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+      p.ID, p.Source, p.URL, p.ShortURL, p.Title,
+      p.Currency, p.Price, p.PriceLow, p.PriceHigh, p.Stock,
+      p.Sales, p.Category, comments, ut, ut)
+    return e
+  }
+  // 不需要更新last_dispatch_time字段，因为之前分发任务的时候已经更新过了
+  _, e = s.q.Exec(`UPDATE product SET source=?, url=?, short_url=?, title=?, currency=?, price=?, price_low=?, price_high=?, stock=?, sales=?, category=?, comments=?, update_time=? WHERE id=?`,
+    p.Source, p.URL, p.ShortURL, p.Title, p.Currency,
+    p.Price, p.PriceLow, p.PriceHigh, p.Stock, p.Sales,
+    p.Category, comments, ut, p.ID)
+  return e
+}
+
+func (s *mysqlStore) GetProduct(productID string) (*Product, error) {
+  p := NewProduct()
+  var comments string
+  r := s.q.QueryRow(`SELECT _id, id, source, url, short_url, title, currency, price, price_low, price_high, stock, sales, category, comments, update_time FROM product WHERE id=? LIMIT 1`, productID)
+  e := r.Scan(&p.AID, &p.ID, &p.Source, &p.URL, &p.ShortURL,
+    &p.Title, &p.Currency, &p.Price, &p.PriceLow, &p.PriceHigh,
+    &p.Stock, &p.Sales, &p.Category, &comments, &p.UpdateTime)
+  if e == sql.ErrNoRows {
+    return nil, nil
+  }
+  if e != nil {
+    return nil, e
+  }
+  if comments != "" {
+    json.Unmarshal([]byte(comments), &p.Comments)
+  }
+  return p, nil
+}
+
+func (s *mysqlStore) WatchersOf(productID string) ([]*ProductWatch, error) {
+  rows, e := s.q.Query(`SELECT user_id, currency, price, price_low, price_high, stock, watch_time, remind_decrease_option, remind_decrease_value, remind_increase_option, remind_increase_value FROM product_watch WHERE product_id=? AND state=?`, productID, StateWatch)
+  if e != nil {
+    return nil, e
+  }
+  defer rows.Close()
+  ret := make([]*ProductWatch, 0, 8)
+  for rows.Next() {
+    pw := &ProductWatch{ProductID: productID, State: StateWatch}
+    e := rows.Scan(&pw.UserID, &pw.Currency, &pw.Price, &pw.PriceLow, &pw.PriceHigh,
+      &pw.Stock, &pw.WatchTime, &pw.Rdo, &pw.Rdv, &pw.Rio, &pw.Riv)
+    if e != nil {
+      return ret, e
+    }
+    ret = append(ret, pw)
+  }
+  return ret, rows.Err()
+}
+
+func (s *mysqlStore) WatchersOfProducts(productIDs []string) (map[string][]*ProductWatch, error) {
+  ret := make(map[string][]*ProductWatch, len(productIDs))
+  if len(productIDs) == 0 {
+    return ret, nil
+  }
+  args := make([]interface{}, 0, len(productIDs)+1)
+  for _, v := range productIDs {
+    args = append(args, v)
+  }
+  args = append(args, StateWatch)
+  rows, e := s.q.Query(`SELECT product_id, user_id, currency, price, price_low, price_high, stock, watch_time, remind_decrease_option, remind_decrease_value, remind_increase_option, remind_increase_value FROM product_watch WHERE product_id IN (?`+strings.Repeat(`, ?`, len(productIDs)-1)+`) AND state=?`, args...)
+  if e != nil {
+    return nil, e
+  }
+  defer rows.Close()
+  for rows.Next() {
+    pw := &ProductWatch{State: StateWatch}
+    e := rows.Scan(&pw.ProductID, &pw.UserID, &pw.Currency, &pw.Price, &pw.PriceLow, &pw.PriceHigh,
+      &pw.Stock, &pw.WatchTime, &pw.Rdo, &pw.Rdv, &pw.Rio, &pw.Riv)
+    if e != nil {
+      return ret, e
+    }
+    ret[pw.ProductID] = append(ret[pw.ProductID], pw)
+  }
+  return ret, rows.Err()
+}
+
+func (s *mysqlStore) CountWatchers(productID string) (int, error) {
+  ret := 0
+  e := s.q.QueryRow(`SELECT COUNT(_id) FROM product_watch WHERE product_id=? AND state=?`, productID, StateWatch).Scan(&ret)
+  return ret, e
+}
+
+func (s *mysqlStore) UserLocales(userIDs []string) (map[string]string, error) {
+  ret := make(map[string]string, len(userIDs))
+  if len(userIDs) == 0 {
+    return ret, nil
+  }
+  args := make([]interface{}, 0, len(userIDs))
+  for _, v := range userIDs {
+    args = append(args, v)
+  }
+  rows, e := s.q.Query(`SELECT user_id, locale FROM user_locale WHERE user_id IN (?`+strings.Repeat(`, ?`, len(userIDs)-1)+`)`, args...)
+  if e != nil {
+    return nil, e
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var uid, locale string
+    e := rows.Scan(&uid, &locale)
+    if e != nil {
+      return ret, e
+    }
+    ret[uid] = locale
+  }
+  return ret, rows.Err()
+}
+
+func (s *mysqlStore) RecordNotifications(arr []*NotifyRecord) error {
+  if len(arr) == 0 {
+    return nil
+  }
+  args := make([]interface{}, 0, len(arr)*8)
+  for _, v := range arr {
+    args = append(args, v.UserID, v.ProductID, v.Event, v.Currency,
+      v.Price, v.PriceLow, v.PriceHigh, v.NotifyTime.Format(times.DateTimeSFormat))
+  }
+  _, e := s.q.Exec(`INSERT INTO notify_ledger (user_id, product_id, event, currency, price, price_low, price_high, notify_time) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`+strings.Repeat(`, (?, ?, ?, ?, ?, ?, ?, ?)`, len(arr)-1), args...)
+  return e
+}
+
+func (s *mysqlStore) NotifyStates(productID string) (map[string]map[string]*NotifyState, error) {
+  rows, e := s.q.Query(`SELECT l.user_id, l.event, MAX(l.notify_time), MIN(l.price) FROM notify_ledger l JOIN product_watch w ON w.user_id=l.user_id AND w.product_id=l.product_id WHERE l.product_id=? AND w.state=? AND l.notify_time>=w.watch_time GROUP BY l.user_id, l.event`, productID, StateWatch)
+  if e != nil {
+    return nil, e
+  }
+  defer rows.Close()
+  ret := make(map[string]map[string]*NotifyState, 16)
+  for rows.Next() {
+    var uid, event string
+    st := &NotifyState{}
+    e := rows.Scan(&uid, &event, &st.LastTime, &st.LowestPrice)
+    if e != nil {
+      return ret, e
+    }
+    if _, ok := ret[uid]; !ok {
+      ret[uid] = make(map[string]*NotifyState, 2)
+    }
+    ret[uid][event] = st
+  }
+  return ret, rows.Err()
+}
+
+func (s *mysqlStore) CountUpdates(productID string, since time.Time) (int, error) {
+  ret := 0
+  e := s.q.QueryRow(`SELECT COUNT(_id) FROM product_update WHERE id=? AND update_time>=?`, productID, since.Format(times.DateTimeSFormat)).Scan(&ret)
+  return ret, e
+}
+
+func (s *mysqlStore) Tx(f func(s Store) error) error {
+  // 已经在事务中
+  if _, ok := s.q.(*sql.Tx); ok {
+    return f(s)
+  }
+  tx, e := s.db.Begin()
+  if e != nil {
+    return e
+  }
+  e = f(&mysqlStore{db: s.db, q: tx})
+  if e != nil {
+    tx.Rollback()
+    return e
+  }
+  return tx.Commit()
+}
+
+func (s *mysqlStore) Ping() error {
+  ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+  defer cancel()
+  return s.db.PingContext(ctx)
+}
+
+func (s *mysqlStore) Close() error {
+  return s.db.Close()
+}
@@ -51,6 +51,9 @@ type Product struct {
   Category   string    `json:"category,omitempty"`
   Comments   Comments  `json:"comments,omitempty"`
   UpdateTime time.Time `json:"update_time,omitempty"`
+
+  // 只用于商品轮转，不发给runner
+  LastDispatchTime time.Time `json:"-"`
 }
 
 func NewProduct() *Product {
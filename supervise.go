@@ -0,0 +1,41 @@
+package main
+
+import (
+  "time"
+)
+
+const superviseInterval = time.Second * 10
+
+// database/sql在连接断开后会自动重连，这里只定期检查连接状态，
+// 状态变化时输出日志，断开期间按指数退避检查
+func superviseDB() {
+  up := true
+  metricConnUp.Set(1, "database")
+  d := superviseInterval
+  for {
+    select {
+    case <-stopChan:
+      return
+    case <-time.After(d):
+    }
+    e := store.Ping()
+    switch {
+    case e != nil && up:
+      up = false
+      metricConnUp.Set(0, "database")
+      logger.Error().Err(e).Msg("database connection lost")
+      d = reconnectMinInterval
+    case e != nil:
+      d *= 2
+      if d > reconnectMaxInterval {
+        d = reconnectMaxInterval
+      }
+      logger.Warn().Err(e).Msgf("database still unavailable, will check %s later", d)
+    case !up:
+      up = true
+      metricConnUp.Set(1, "database")
+      logger.Info().Msg("database reconnected")
+      d = superviseInterval
+    }
+  }
+}
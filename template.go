@@ -0,0 +1,154 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync/atomic"
+  "text/template"
+)
+
+// 通知的事件类型，每种语言每种类型一个模板，文件名为<语言>/<类型>.tmpl
+const (
+  EventDecrease = "decrease"
+  EventIncrease = "increase"
+  EventRange    = "range"
+)
+
+// 通知模板的数据
+type MsgData struct {
+  // decrease（降价）、increase（涨价）或range（区间价格变动）
+  Event string
+  // 接收者的语言（zh-CN、en或ja）
+  Locale  string
+  Product *Product
+  Watch   *ProductWatch
+  // 商品标题，超过30个字时截断并加上...
+  Title string
+  // 现价和关注价，已按接收者的语言和各自的币种格式化（如￥12.50、$1,234.50），
+  // 区间价格使用PriceLow/PriceHigh/WatchPriceLow/WatchPriceHigh
+  Price          string
+  WatchPrice     string
+  PriceLow       string
+  PriceHigh      string
+  WatchPriceLow  string
+  WatchPriceHigh string
+  // 现价-关注价（降价时为负数）
+  Delta float64
+  // 涨幅或降幅的百分比，四舍五入取整，始终为正数
+  Percent int
+  // 商品的短链接
+  URL string
+}
+
+// 内置模板（消息目录），模板目录中没有对应的文件时使用
+var defaultTemplates = map[string]map[string]string{
+  LocaleZhCN: {
+    EventDecrease: `{{.Title}} 降价了，关注价{{.WatchPrice}} 现价{{.Price}} 降幅{{.Percent}}% {{.URL}}`,
+    EventIncrease: `{{.Title}} 涨价了，关注价{{.WatchPrice}} 现价{{.Price}} 涨幅{{.Percent}}% {{.URL}}`,
+    EventRange:    `{{.Title}} 价格有变动，关注价[{{.WatchPriceLow}}-{{.WatchPriceHigh}}] 现价[{{.PriceLow}}-{{.PriceHigh}}] {{.URL}}`,
+  },
+  LocaleEn: {
+    EventDecrease: `{{.Title}} dropped in price: watched at {{.WatchPrice}}, now {{.Price}} (-{{.Percent}}%) {{.URL}}`,
+    EventIncrease: `{{.Title}} went up in price: watched at {{.WatchPrice}}, now {{.Price}} (+{{.Percent}}%) {{.URL}}`,
+    EventRange:    `{{.Title}} price changed: watched at [{{.WatchPriceLow}}-{{.WatchPriceHigh}}], now [{{.PriceLow}}-{{.PriceHigh}}] {{.URL}}`,
+  },
+  LocaleJa: {
+    EventDecrease: `{{.Title}} が値下がりしました。登録時価格{{.WatchPrice}} 現在価格{{.Price}} 値下がり率{{.Percent}}% {{.URL}}`,
+    EventIncrease: `{{.Title}} が値上がりしました。登録時価格{{.WatchPrice}} 現在価格{{.Price}} 値上がり率{{.Percent}}% {{.URL}}`,
+    EventRange:    `{{.Title}} の価格が変動しました。登録時価格[{{.WatchPriceLow}}-{{.WatchPriceHigh}}] 現在価格[{{.PriceLow}}-{{.PriceHigh}}] {{.URL}}`,
+  },
+}
+
+// 模板中可以使用的函数：
+// currency：按模板的语言和币种格式化价格，如{{currency .Product.Currency .Product.Price}}，
+// truncate：截断字符串，如{{truncate 20 .Product.Title}}
+func templateFuncs(locale string) template.FuncMap {
+  return template.FuncMap{
+    "currency": func(currency int, v float64) string {
+      return formatPrice(locale, currency, v)
+    },
+    "truncate": truncate,
+  }
+}
+
+// map[string]map[string]*template.Template（语言->事件->模板），重新加载时整体替换
+var msgTemplates atomic.Value
+
+func initTemplates() {
+  e := loadTemplates()
+  if e != nil {
+    panic(e)
+  }
+  logger.Info().Msgf("init templates, ok, dir=%s", Conf.Notify.TemplateDir)
+}
+
+// 收到SIGHUP时重新加载，失败时继续使用原来的模板
+func reloadTemplates() {
+  e := loadTemplates()
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: reloadTemplates")
+    return
+  }
+  logger.Info().Msg("reload templates, ok")
+}
+
+func loadTemplates() error {
+  m := make(map[string]map[string]*template.Template, len(defaultTemplates))
+  for locale, texts := range defaultTemplates {
+    funcs := templateFuncs(locale)
+    m[locale] = make(map[string]*template.Template, len(texts))
+    for event, text := range texts {
+      if Conf.Notify.TemplateDir != "" {
+        data, e := ioutil.ReadFile(filepath.Join(Conf.Notify.TemplateDir, locale, event+".tmpl"))
+        if e == nil {
+          text = string(data)
+        } else if !os.IsNotExist(e) {
+          return e
+        }
+      }
+      t, e := template.New(event).Funcs(funcs).Parse(text)
+      if e != nil {
+        return fmt.Errorf("template %s/%s: %s", locale, event, e)
+      }
+      m[locale][event] = t
+    }
+  }
+  msgTemplates.Store(m)
+  return nil
+}
+
+// 按data.Locale选择模板，渲染失败时返回空字符串（不发送）
+func renderMsg(data *MsgData) string {
+  m, _ := msgTemplates.Load().(map[string]map[string]*template.Template)
+  if m == nil {
+    e := loadTemplates()
+    if e != nil {
+      logger.Error().Err(e).Msg("ERR: loadTemplates")
+      return ""
+    }
+    m = msgTemplates.Load().(map[string]map[string]*template.Template)
+  }
+  t, ok := m[normalizeLocale(data.Locale)][data.Event]
+  if !ok {
+    return ""
+  }
+  buf := &bytes.Buffer{}
+  e := t.Execute(buf, data)
+  if e != nil {
+    logger.Error().Err(e).Msgf("ERR: Execute template %s/%s", data.Locale, data.Event)
+    return ""
+  }
+  return strings.TrimSpace(buf.String())
+}
+
+func truncate(n int, s string) string {
+  r := []rune(s)
+  if len(r) > n {
+    return string(r[:n]) + "..."
+  }
+  return s
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+  "sync"
+  "time"
+)
+
+var (
+  // 每个worker一个队列连接
+  workerQueues []Queue
+
+  // 正在处理的商品，保证同一个商品的report不会被并发处理
+  productLocks = newKeyLocks()
+)
+
+func initWorkers() {
+  n := Conf.Task.Workers
+  if n <= 0 {
+    n = 1
+  }
+  workerQueues = make([]Queue, 0, n)
+  for i := 0; i < n; i++ {
+    workerQueues = append(workerQueues, wrapQueue(connectQueue()))
+  }
+  logger.Info().Msgf("init workers, ok, %d workers", n)
+}
+
+func closeWorkers() {
+  for _, q := range workerQueues {
+    q.Close()
+  }
+}
+
+// 一直取report任务并处理，直到开始退出
+func consume(name string, q Queue) {
+  for !stopping() {
+    tick(name, time.Second*time.Duration(reserveTimeout()))
+    job, task, e := reserveJob(q)
+    if job == nil {
+      // 队列不可用时等待重连，避免空转
+      if e != nil {
+        select {
+        case <-stopChan:
+        case <-time.After(time.Second):
+        }
+      }
+      continue
+    }
+    trackJob(q, job)
+    if e != nil {
+      failJob(q, job, "", e, true)
+    } else {
+      processJob(q, job, task)
+    }
+    untrackJob(job)
+  }
+}
+
+func processJob(q Queue, job *Job, task *Task) {
+  it := reportInflight(task.ID)
+  if len(task.Payloads) > 0 {
+    metricPayloadsProcessed.Add(float64(len(task.Payloads)))
+    ids := make([]string, 0, len(task.Payloads))
+    for _, v := range task.Payloads {
+      if v.Product != nil && v.Product.ID != "" {
+        ids = append(ids, v.Product.ID)
+      }
+    }
+    // 推送和记录通知之前都不能释放，
+    // 否则两个worker可能在对方记录之前都通过了去重检查，重复推送
+    productLocks.Lock(ids)
+    // 获取所有的价格较上次更新有变动的商品ID
+    arr, e := collectChanged(task)
+    if e == nil {
+      metricProductsChanged.Add(float64(len(arr)))
+      if len(arr) > 0 {
+        e = putMsgJob(arr)
+      }
+    }
+    productLocks.Unlock(ids)
+    if e != nil {
+      failJob(q, job, task.ID, e, false)
+      return
+    }
+  }
+  retryFailed(task, it)
+  e := q.Ack(job)
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: Ack")
+  }
+}
+
+// 一次锁定多个key，要么全部锁定要么等待，所以不会死锁
+type keyLocks struct {
+  l    *sync.Mutex
+  c    *sync.Cond
+  busy map[string]struct{}
+}
+
+func newKeyLocks() *keyLocks {
+  l := &sync.Mutex{}
+  return &keyLocks{
+    l:    l,
+    c:    sync.NewCond(l),
+    busy: make(map[string]struct{}, 256),
+  }
+}
+
+func (k *keyLocks) Lock(keys []string) {
+  k.l.Lock()
+  defer k.l.Unlock()
+  for k.anyBusy(keys) {
+    k.c.Wait()
+  }
+  for _, v := range keys {
+    k.busy[v] = struct{}{}
+  }
+}
+
+func (k *keyLocks) Unlock(keys []string) {
+  k.l.Lock()
+  for _, v := range keys {
+    delete(k.busy, v)
+  }
+  k.l.Unlock()
+  k.c.Broadcast()
+}
+
+func (k *keyLocks) anyBusy(keys []string) bool {
+  for _, v := range keys {
+    if _, ok := k.busy[v]; ok {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+  "encoding/json"
+  "sync"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+)
+
+// 读取通知记录较慢的存储，用于放大并发处理的时间窗口
+type slowNotifyStore struct {
+  *memoryStore
+}
+
+func (s slowNotifyStore) NotifyStates(productID string) (map[string]map[string]*NotifyState, error) {
+  m, e := s.memoryStore.NotifyStates(productID)
+  time.Sleep(time.Millisecond * 20)
+  return m, e
+}
+
+// 同一个商品的两个report并发处理时，冷却时间内只能推送一次
+func TestProcessJobNotifyOnce(t *testing.T) {
+  defer newTestKV(t)()
+  defer setDispatchConf()()
+  Conf.Beanstalk.PutTubeMsg = "msg"
+  Conf.Notify.TemplateDir = ""
+  Conf.Notify.Cooldown.Decrease = 60
+  for i := 0; i < 3; i++ {
+    s := newTestStore()
+    store = slowNotifyStore{s}
+    q := newTestQueue()
+    t0 := times.Now().Add(-time.Hour)
+    s.RecordProductUpdate(reportProduct("p1", 100, t0))
+    s.addWatch(&ProductWatch{UserID: "u1", ProductID: "p1", Price: 100, WatchTime: t0, Rdo: 2, Rdv: 10})
+
+    jobs := make([]*Job, 0, 2)
+    tasks := make([]*Task, 0, 2)
+    for j, price := range []float64{80, 70} {
+      task := reportTask("", &Payload{Product: reportProduct("p1", price, t0.Add(time.Minute*time.Duration(j+1)))})
+      data, _ := json.Marshal(task)
+      q.Publish("report", 0, 0, 60, data)
+      job, e := q.Reserve("report", 0)
+      if e != nil {
+        t.Fatal(e)
+      }
+      jobs = append(jobs, job)
+      tasks = append(tasks, task)
+    }
+    wg := &sync.WaitGroup{}
+    // 先处理较早的report，否则较晚的先处理后较早的不算变动
+    for j := range jobs {
+      wg.Add(1)
+      go func(j int) {
+        defer wg.Done()
+        processJob(q, jobs[j], tasks[j])
+      }(j)
+      time.Sleep(time.Millisecond * 5)
+    }
+    wg.Wait()
+
+    if n := len(s.d.ledger); n != 1 {
+      t.Fatalf("round %d: %d notifications recorded", i, n)
+    }
+    if _, e := q.Reserve("msg", 0); e != nil {
+      t.Fatalf("round %d: %s", i, e)
+    }
+    if _, e := q.Reserve("msg", 0); e != ErrReserveTimeout {
+      t.Fatalf("round %d: more than one msg job", i)
+    }
+  }
+}
+
+// 推送消息发布失败时report任务放回队列，消息保留在msg_outbox中稍后重新发布
+func TestProcessJobPublishMsgFailed(t *testing.T) {
+  defer newTestKV(t)()
+  defer setDispatchConf()()
+  Conf.Beanstalk.PutTubeMsg = "msg"
+  Conf.Notify.TemplateDir = ""
+  Conf.Retry.MaxAttempts = 5
+  Conf.Retry.Delay = 0
+  s := newTestStore()
+  q := newTestQueue()
+  queue = &failQueue{q}
+  t0 := times.Now().Add(-time.Hour)
+  s.RecordProductUpdate(reportProduct("p1", 100, t0))
+  s.addWatch(&ProductWatch{UserID: "u1", ProductID: "p1", Price: 100, WatchTime: t0, Rdo: 2, Rdv: 10})
+
+  task := reportTask("", &Payload{Product: reportProduct("p1", 80, t0.Add(time.Minute))})
+  data, _ := json.Marshal(task)
+  q.Publish("report", 0, 0, 60, data)
+  job, _ := q.Reserve("report", 0)
+  processJob(q, job, task)
+  if len(s.d.ledger) != 0 {
+    t.Fatalf("notifications recorded: %d", len(s.d.ledger))
+  }
+  if _, e := q.Reserve("report", 0); e != nil {
+    t.Fatalf("report job not released: %s", e)
+  }
+
+  // 队列恢复后重新发布
+  queue = q
+  recoverPendingMsgs(false)
+  if len(s.d.ledger) != 1 {
+    t.Fatalf("notifications recorded: %d", len(s.d.ledger))
+  }
+  if _, e := q.Reserve("msg", 0); e != nil {
+    t.Fatalf("msg job not published: %s", e)
+  }
+  recoverPendingMsgs(true)
+  if len(s.d.ledger) != 1 {
+    t.Fatalf("msg committed twice, %d notifications", len(s.d.ledger))
+  }
+}